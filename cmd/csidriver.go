@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// csiDriverChecker tracks whether the CSI drivers referenced by the sidecar volumes are installed
+type csiDriverChecker struct {
+	client  kubernetes.Interface
+	drivers []string
+
+	mu      sync.RWMutex
+	missing []string
+}
+
+func newCSIDriverChecker(client kubernetes.Interface, cfg *Config) *csiDriverChecker {
+	checker := &csiDriverChecker{client: client}
+	seen := map[string]bool{}
+	for _, v := range cfg.Volumes {
+		if v.CSI != nil && !seen[v.CSI.Driver] {
+			seen[v.CSI.Driver] = true
+			checker.drivers = append(checker.drivers, v.CSI.Driver)
+		}
+	}
+	return checker
+}
+
+// check looks up the CSIDriver objects and records the missing drivers,
+// the last known state is kept when the API server cannot be queried
+func (c *csiDriverChecker) check(ctx context.Context) ([]string, error) {
+	var missing []string
+	for _, driver := range c.drivers {
+		_, err := c.client.StorageV1().CSIDrivers().Get(ctx, driver, metav1.GetOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("failed to get csidriver %s: %v", driver, err)
+		}
+		if err != nil {
+			missing = append(missing, driver)
+			csiDriverPresent.WithLabelValues(driver).Set(0)
+		} else {
+			csiDriverPresent.WithLabelValues(driver).Set(1)
+		}
+	}
+
+	c.mu.Lock()
+	c.missing = missing
+	c.mu.Unlock()
+	return missing, nil
+}
+
+// run re-checks the drivers periodically until the context is done
+func (c *csiDriverChecker) run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			missing, err := c.check(ctx)
+			if err != nil {
+				warningLogger.Printf("Failed to check CSI drivers: %v", err)
+			} else if len(missing) > 0 {
+				warningLogger.Printf("CSI drivers %v are not installed, pods are admitted without sidecars", missing)
+			}
+		}
+	}
+}
+
+// missingDrivers returns the drivers found missing by the last check
+func (c *csiDriverChecker) missingDrivers() []string {
+	if c == nil {
+		return nil
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.missing
+}
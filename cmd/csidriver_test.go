@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// csiTestConfig returns a config with a CSI volume per driver
+func csiTestConfig(drivers ...string) *Config {
+	cfg := &Config{
+		Containers: []corev1.Container{{Name: "sidecar", Image: "sidecar"}},
+		Volumes:    []corev1.Volume{{Name: "scratch", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}},
+	}
+	for i, driver := range drivers {
+		cfg.Volumes = append(cfg.Volumes, corev1.Volume{
+			Name:         fmt.Sprintf("csi-%d", i),
+			VolumeSource: corev1.VolumeSource{CSI: &corev1.CSIVolumeSource{Driver: driver}},
+		})
+	}
+	return cfg
+}
+
+func csiDriver(name string) *storagev1.CSIDriver {
+	return &storagev1.CSIDriver{ObjectMeta: metav1.ObjectMeta{Name: name}}
+}
+
+func TestNewCSIDriverChecker(t *testing.T) {
+	checker := newCSIDriverChecker(fake.NewSimpleClientset(), csiTestConfig("secrets.csi.k8s.io", "blob.csi.azure.com", "secrets.csi.k8s.io"))
+	want := []string{"secrets.csi.k8s.io", "blob.csi.azure.com"}
+	if !reflect.DeepEqual(checker.drivers, want) {
+		t.Errorf("drivers = %v, want %v", checker.drivers, want)
+	}
+
+	if checker := newCSIDriverChecker(fake.NewSimpleClientset(), csiTestConfig()); len(checker.drivers) != 0 {
+		t.Errorf("drivers = %v, want none without CSI volumes", checker.drivers)
+	}
+}
+
+func TestCSIDriverCheck(t *testing.T) {
+	tests := []struct {
+		name        string
+		installed   []string
+		wantMissing []string
+	}{
+		{name: "installed", installed: []string{"present.csi.example.com", "missing.csi.example.com"}},
+		{name: "missing", installed: []string{"present.csi.example.com"}, wantMissing: []string{"missing.csi.example.com"}},
+		{name: "none installed", wantMissing: []string{"present.csi.example.com", "missing.csi.example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var objects []runtime.Object
+			for _, name := range tt.installed {
+				objects = append(objects, csiDriver(name))
+			}
+			checker := newCSIDriverChecker(fake.NewSimpleClientset(objects...), csiTestConfig("present.csi.example.com", "missing.csi.example.com"))
+
+			missing, err := checker.check(context.Background())
+			if err != nil {
+				t.Fatalf("check returned error: %v", err)
+			}
+			if !reflect.DeepEqual(missing, tt.wantMissing) {
+				t.Errorf("check = %v, want %v", missing, tt.wantMissing)
+			}
+			if got := checker.missingDrivers(); !reflect.DeepEqual(got, tt.wantMissing) {
+				t.Errorf("missingDrivers = %v, want %v", got, tt.wantMissing)
+			}
+			for _, driver := range checker.drivers {
+				want := 1.0
+				for _, name := range tt.wantMissing {
+					if name == driver {
+						want = 0
+					}
+				}
+				if got := testutil.ToFloat64(csiDriverPresent.WithLabelValues(driver)); got != want {
+					t.Errorf("%s present gauge = %v, want %v", driver, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCSIDriverCheckKeepsStateOnError(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	checker := newCSIDriverChecker(client, csiTestConfig("missing.csi.example.com"))
+	if _, err := checker.check(context.Background()); err != nil {
+		t.Fatalf("check returned error: %v", err)
+	}
+
+	client.PrependReactor("get", "csidrivers", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("connection refused")
+	})
+	if _, err := checker.check(context.Background()); err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("check = %v, want the API error", err)
+	}
+	if got, want := checker.missingDrivers(), []string{"missing.csi.example.com"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("missingDrivers = %v, want the last known state %v", got, want)
+	}
+}
+
+func TestMutateMissingCSIDriver(t *testing.T) {
+	cfg := csiTestConfig("missing.csi.example.com")
+	checker := newCSIDriverChecker(fake.NewSimpleClientset(), cfg)
+	if _, err := checker.check(context.Background()); err != nil {
+		t.Fatalf("check returned error: %v", err)
+	}
+	whsvr := newTestWebhookServer(cfg)
+	whsvr.csiDrivers = checker
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "test-ns"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+	}
+	resp := mutatePod(t, whsvr, pod, admissionv1.Create)
+	if len(resp.Patch) != 0 {
+		t.Errorf("patch = %s, want the pod admitted unmutated", resp.Patch)
+	}
+	want := []string{"sidecars not injected: CSI drivers [missing.csi.example.com] are not installed"}
+	if !reflect.DeepEqual(resp.Warnings, want) {
+		t.Errorf("warnings = %q, want %q", resp.Warnings, want)
+	}
+
+	// once the driver is installed the pod is injected again
+	checker.client = fake.NewSimpleClientset(csiDriver("missing.csi.example.com"))
+	if _, err := checker.check(context.Background()); err != nil {
+		t.Fatalf("check returned error: %v", err)
+	}
+	resp = mutatePod(t, whsvr, pod, admissionv1.Create)
+	if mutated := patchedPod(t, pod, resp); len(mutated.Spec.Containers) != 2 {
+		t.Errorf("containers = %v, want the sidecar injected", containerNames(mutated.Spec.Containers))
+	}
+}
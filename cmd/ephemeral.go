@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const ephemeralContainersSubResource = "ephemeralcontainers"
+
+// mutateEphemeralContainers mounts the injected volumes into the ephemeral containers added
+// to a previously injected pod, so `kubectl debug` sessions see the same data as the pod
+func (whsvr *WebhookServer) mutateEphemeralContainers(req *admissionv1.AdmissionRequest, pod *corev1.Pod) *admissionv1.AdmissionResponse {
+	if strings.ToLower(pod.Annotations[admissionWebhookAnnotationStatusKey]) != "injected" {
+		infoLogger.Printf("Skipping ephemeral containers of %s/%s, the pod was not injected", req.Namespace, req.Name)
+		return &admissionv1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+
+	// ephemeral containers can not be changed once added, only mount into the new ones
+	var oldPod corev1.Pod
+	if len(req.OldObject.Raw) > 0 {
+		if err := json.Unmarshal(req.OldObject.Raw, &oldPod); err != nil {
+			warningLogger.Printf("Could not unmarshal raw old object: %v", err)
+			return &admissionv1.AdmissionResponse{
+				Result: &metav1.Status{
+					Message: err.Error(),
+				},
+			}
+		}
+	}
+	existing := map[string]bool{}
+	for _, c := range oldPod.Spec.EphemeralContainers {
+		existing[c.Name] = true
+	}
+
+	mounts, skipped := injectedVolumeMounts(whsvr.config(), pod)
+	var patch []patchOperation
+	var warnings []string
+	for i, c := range pod.Spec.EphemeralContainers {
+		if existing[c.Name] {
+			continue
+		}
+		target := corev1.Container{Name: c.Name, VolumeMounts: c.VolumeMounts}
+		patch = addVolumeMounts(patch, &target, i, mounts, "/spec/ephemeralContainers")
+		for _, name := range skipped {
+			warnings = append(warnings, fmt.Sprintf("volume %s not mounted into ephemeral container %s, ephemeral containers can't use subPath", name, c.Name))
+		}
+	}
+	if len(patch) == 0 {
+		return &admissionv1.AdmissionResponse{
+			Allowed:  true,
+			Warnings: warnings,
+		}
+	}
+
+	patchBytes, err := json.Marshal(patch)
+	if err != nil {
+		return &admissionv1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: err.Error(),
+			},
+		}
+	}
+
+	infoLogger.Printf("AdmissionResponse for ephemeral containers of %s/%s: patch=%v", req.Namespace, req.Name, string(patchBytes))
+	return &admissionv1.AdmissionResponse{
+		Allowed:  true,
+		Warnings: warnings,
+		Patch:    patchBytes,
+		PatchType: func() *admissionv1.PatchType {
+			pt := admissionv1.PatchTypeJSONPatch
+			return &pt
+		}(),
+	}
+}
+
+// volumesAnnotation maps the configured volume names to the names they are injected with as JSON,
+// injected holds the configured volumes in the same order, renamed on a name clash
+func volumesAnnotation(configured, injected []corev1.Volume) (string, error) {
+	names := make(map[string]string, len(injected))
+	for i := range injected {
+		names[configured[i].Name] = injected[i].Name
+	}
+	data, err := json.Marshal(names)
+	return string(data), err
+}
+
+// injectedVolumeMounts returns the mounts of the injected volumes still present on the pod,
+// at the path the sidecars or the pod containers mount them. The volumes are looked up by the
+// names recorded in the volumes annotation, pods injected before it was recorded fall back to the
+// configured names. Mounts using a subPath are returned as skipped, ephemeral containers can't use one.
+func injectedVolumeMounts(cfg *Config, pod *corev1.Pod) ([]corev1.VolumeMount, []string) {
+	var names map[string]string
+	if data, ok := pod.Annotations[admissionWebhookAnnotationVolumesKey]; ok {
+		if err := json.Unmarshal([]byte(data), &names); err != nil {
+			warningLogger.Printf("Ignoring invalid %s annotation of %s/%s: %v", admissionWebhookAnnotationVolumesKey, pod.Namespace, pod.Name, err)
+			names = nil
+		}
+	}
+
+	var mounts []corev1.VolumeMount
+	var subPathMounts []string
+	seen := map[string]bool{}
+	add := func(m corev1.VolumeMount) {
+		if names != nil {
+			name, ok := names[m.Name]
+			if !ok {
+				return
+			}
+			m.Name = name
+		}
+		if seen[m.Name] || !hasVolume(pod.Spec.Volumes, m.Name) {
+			return
+		}
+		if m.SubPath != "" || m.SubPathExpr != "" {
+			subPathMounts = append(subPathMounts, m.Name)
+			return
+		}
+		seen[m.Name] = true
+		mounts = append(mounts, m)
+	}
+
+	for _, m := range cfg.appVolumeMounts {
+		add(m)
+	}
+	if sidecarInfoVolume {
+		add(corev1.VolumeMount{Name: sidecarInfoVolumeName, MountPath: sidecarInfoPath, ReadOnly: true})
+	}
+	for _, c := range cfg.Containers {
+		for _, m := range c.VolumeMounts {
+			add(m)
+		}
+	}
+	// a volume is only skipped if no mount of it without subPath was found
+	var skipped []string
+	for _, name := range subPathMounts {
+		if !seen[name] {
+			seen[name] = true
+			skipped = append(skipped, name)
+		}
+	}
+	return mounts, skipped
+}
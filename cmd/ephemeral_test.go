@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// ephemeralTestConfig matches the injected pod of testdata/ephemeral/review.json, the pod
+// already had a data volume so the injected one was renamed to data-2
+func ephemeralTestConfig() *Config {
+	return &Config{
+		Containers: []corev1.Container{{
+			Name:  "sidecar",
+			Image: "sidecar",
+			VolumeMounts: []corev1.VolumeMount{
+				{Name: "data", MountPath: "/data"},
+				{Name: "sidecar-config", MountPath: "/etc/sidecar"},
+			},
+		}},
+		Volumes: []corev1.Volume{
+			{Name: "data", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+			{Name: "sidecar-config"},
+			{Name: "reference"},
+		},
+		appVolumeMounts: []corev1.VolumeMount{
+			{Name: "data", MountPath: "/data"},
+			{Name: "reference", MountPath: "/reference", SubPath: "v1", ReadOnly: true},
+		},
+	}
+}
+
+func TestServeEphemeralContainersFixture(t *testing.T) {
+	setBoolFlag(t, &ephemeralContainers, true)
+	body, err := ioutil.ReadFile(filepath.Join("testdata", "ephemeral", "review.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	whsvr := newTestWebhookServer(ephemeralTestConfig())
+	w, review := serveReview(t, whsvr, string(body), "application/json")
+	if review == nil {
+		t.Fatalf("serve returned HTTP %d %q, want an AdmissionReview", w.Code, w.Body.String())
+	}
+	resp := review.Response
+	if !resp.Allowed || resp.UID != "0df28fbd-5f5f-4f2c-8f0e-5b8d8c3c6f1a" {
+		t.Fatalf("response = %+v, want allowed with the request uid", resp)
+	}
+
+	// only the new debugger-2 is patched, with the renamed data volume and without the subPath mount
+	wantPatch := `[` +
+		`{"op":"test","path":"/spec/ephemeralContainers/1/name","value":"debugger-2"},` +
+		`{"op":"add","path":"/spec/ephemeralContainers/1/volumeMounts/-","value":{"name":"data-2","mountPath":"/data"}},` +
+		`{"op":"add","path":"/spec/ephemeralContainers/1/volumeMounts/-","value":{"name":"sidecar-config","mountPath":"/etc/sidecar"}}` +
+		`]`
+	if string(resp.Patch) != wantPatch {
+		t.Errorf("patch = %s\nwant %s", resp.Patch, wantPatch)
+	}
+	wantWarnings := []string{"volume reference not mounted into ephemeral container debugger-2, ephemeral containers can't use subPath"}
+	if !reflect.DeepEqual(resp.Warnings, wantWarnings) {
+		t.Errorf("warnings = %q, want %q", resp.Warnings, wantWarnings)
+	}
+
+	var ar admissionv1.AdmissionReview
+	if err := json.Unmarshal(body, &ar); err != nil {
+		t.Fatal(err)
+	}
+	var pod corev1.Pod
+	if err := json.Unmarshal(ar.Request.Object.Raw, &pod); err != nil {
+		t.Fatal(err)
+	}
+	mutated, err := applyPatch(&pod, resp.Patch)
+	if err != nil {
+		t.Fatalf("patch does not apply: %v", err)
+	}
+	for _, c := range mutated.Spec.EphemeralContainers {
+		for _, m := range c.VolumeMounts {
+			if m.SubPath != "" || m.SubPathExpr != "" {
+				t.Errorf("ephemeral container %s mounts %s with a subPath", c.Name, m.Name)
+			}
+		}
+	}
+	if mounts := mutated.Spec.EphemeralContainers[0].VolumeMounts; len(mounts) != 0 {
+		t.Errorf("existing ephemeral container debugger-1 was patched: %+v", mounts)
+	}
+}
+
+func TestMutateEphemeralContainersSkipped(t *testing.T) {
+	notInjected := `{"metadata":{"name":"app","namespace":"test-ns"},"spec":{"containers":[{"name":"app"}],` +
+		`"ephemeralContainers":[{"name":"debugger"}],"volumes":[{"name":"data"}]}}`
+	injected := `{"metadata":{"name":"app","namespace":"test-ns","annotations":{"sidecar-injector-webhook.morven.me/status":"injected"}},` +
+		`"spec":{"containers":[{"name":"app"}],"ephemeralContainers":[{"name":"debugger"}],"volumes":[{"name":"data"}]}}`
+	tests := []struct {
+		name    string
+		enabled bool
+		object  string
+	}{
+		{name: "disabled", object: injected},
+		{name: "pod not injected", enabled: true, object: notInjected},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setBoolFlag(t, &ephemeralContainers, tt.enabled)
+			whsvr := newTestWebhookServer(ephemeralTestConfig())
+			resp := whsvr.mutate(&admissionv1.AdmissionReview{Request: &admissionv1.AdmissionRequest{
+				Kind:        metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+				Operation:   admissionv1.Update,
+				SubResource: ephemeralContainersSubResource,
+				Object:      runtime.RawExtension{Raw: []byte(tt.object)},
+			}})
+			if !resp.Allowed || len(resp.Patch) != 0 {
+				t.Errorf("response = %+v, want allowed without patch", resp)
+			}
+		})
+	}
+}
+
+func TestInjectedVolumeMounts(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotation  string
+		volumes     []string
+		config      func(cfg *Config)
+		wantMounts  []corev1.VolumeMount
+		wantSkipped []string
+	}{
+		{
+			name:       "recorded names",
+			annotation: `{"data":"data-2","reference":"reference","sidecar-config":"sidecar-config"}`,
+			volumes:    []string{"data", "data-2", "reference", "sidecar-config"},
+			wantMounts: []corev1.VolumeMount{
+				{Name: "data-2", MountPath: "/data"},
+				{Name: "sidecar-config", MountPath: "/etc/sidecar"},
+			},
+			wantSkipped: []string{"reference"},
+		},
+		{
+			// pods injected before the names were recorded
+			name:    "configured names",
+			volumes: []string{"data", "reference", "sidecar-config"},
+			wantMounts: []corev1.VolumeMount{
+				{Name: "data", MountPath: "/data"},
+				{Name: "sidecar-config", MountPath: "/etc/sidecar"},
+			},
+			wantSkipped: []string{"reference"},
+		},
+		{
+			name:       "volume not injected",
+			annotation: `{"data":"data-2"}`,
+			volumes:    []string{"data", "data-2", "sidecar-config"},
+			wantMounts: []corev1.VolumeMount{{Name: "data-2", MountPath: "/data"}},
+		},
+		{
+			name:       "volume removed from the pod",
+			annotation: `{"data":"data","reference":"reference","sidecar-config":"sidecar-config"}`,
+			volumes:    []string{"data"},
+			wantMounts: []corev1.VolumeMount{{Name: "data", MountPath: "/data"}},
+		},
+		{
+			name:       "subPath mount with a plain mount of the same volume",
+			annotation: `{"data":"data","reference":"reference","sidecar-config":"sidecar-config"}`,
+			volumes:    []string{"data", "reference", "sidecar-config"},
+			config: func(cfg *Config) {
+				cfg.Containers[0].VolumeMounts = append(cfg.Containers[0].VolumeMounts, corev1.VolumeMount{Name: "reference", MountPath: "/srv/reference"})
+			},
+			wantMounts: []corev1.VolumeMount{
+				{Name: "data", MountPath: "/data"},
+				{Name: "sidecar-config", MountPath: "/etc/sidecar"},
+				{Name: "reference", MountPath: "/srv/reference"},
+			},
+		},
+		{
+			name:       "subPathExpr",
+			annotation: `{"data":"data"}`,
+			volumes:    []string{"data"},
+			config: func(cfg *Config) {
+				cfg.appVolumeMounts[0].SubPathExpr = "$(POD_NAME)"
+				cfg.Containers[0].VolumeMounts = nil
+			},
+			wantSkipped: []string{"data"},
+		},
+		{
+			name:       "invalid annotation falls back to configured names",
+			annotation: `not json`,
+			volumes:    []string{"data"},
+			wantMounts: []corev1.VolumeMount{{Name: "data", MountPath: "/data"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := ephemeralTestConfig()
+			if tt.config != nil {
+				tt.config(cfg)
+			}
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "test-ns"}}
+			if tt.annotation != "" {
+				pod.Annotations = map[string]string{admissionWebhookAnnotationVolumesKey: tt.annotation}
+			}
+			for _, name := range tt.volumes {
+				pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{Name: name})
+			}
+
+			mounts, skipped := injectedVolumeMounts(cfg, pod)
+			if !reflect.DeepEqual(mounts, tt.wantMounts) {
+				t.Errorf("mounts = %+v, want %+v", mounts, tt.wantMounts)
+			}
+			if !reflect.DeepEqual(skipped, tt.wantSkipped) {
+				t.Errorf("skipped = %v, want %v", skipped, tt.wantSkipped)
+			}
+		})
+	}
+}
+
+func TestMutateRecordsInjectedVolumeNames(t *testing.T) {
+	setNameConflictPolicy(t, nameConflictPolicyRename)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "test-ns"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app"}},
+			Volumes:    []corev1.Volume{{Name: "data"}},
+		},
+	}
+
+	for _, enabled := range []bool{false, true} {
+		setBoolFlag(t, &ephemeralContainers, enabled)
+		whsvr := newTestWebhookServer(ephemeralTestConfig())
+		resp := mutatePod(t, whsvr, pod, admissionv1.Create)
+		mutated := patchedPod(t, pod, resp)
+
+		annotation, ok := mutated.Annotations[admissionWebhookAnnotationVolumesKey]
+		if !enabled {
+			if ok {
+				t.Errorf("volumes annotation %q recorded without -ephemeral-containers", annotation)
+			}
+			continue
+		}
+		want := `{"data":"data-2","reference":"reference","sidecar-config":"sidecar-config"}`
+		if annotation != want {
+			t.Errorf("volumes annotation = %q, want %q", annotation, want)
+		}
+		if !hasVolume(mutated.Spec.Volumes, "data-2") {
+			t.Errorf("injected volumes = %v, want data-2", volumeNames(mutated.Spec.Volumes))
+		}
+	}
+}
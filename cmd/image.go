@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	defaultImageRegistry = "docker.io"
+	// docker hub serves the registry API from a different host than its image names
+	dockerHubRegistryHost = "registry-1.docker.io"
+)
+
+// registryClient queries the registries, it is replaced in tests
+var registryClient = &http.Client{Timeout: 10 * time.Second}
+
+var (
+	imagePathComponentRegexp = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|[-]*)[a-z0-9]+)*$`)
+	imageTagRegexp           = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+	imageDigestRegexp        = regexp.MustCompile(`^sha256:[a-f0-9]{64}$`)
+	bearerParamRegexp        = regexp.MustCompile(`(\w+)="([^"]*)"`)
+)
+
+// imageReference is a parsed container image reference
+type imageReference struct {
+	name       string // image name as written, without tag and digest
+	registry   string // registry host, docker.io when not qualified
+	repository string // repository path within the registry
+	tag        string
+	digest     string
+}
+
+// parseImageReference splits the image into registry, repository, tag and digest
+// and returns an error if the reference is malformed
+func parseImageReference(image string) (*imageReference, error) {
+	if image == "" || strings.TrimSpace(image) != image {
+		return nil, fmt.Errorf("invalid image reference %q", image)
+	}
+
+	ref := &imageReference{name: image}
+	if i := strings.Index(ref.name, "@"); i >= 0 {
+		ref.digest = ref.name[i+1:]
+		ref.name = ref.name[:i]
+		if !imageDigestRegexp.MatchString(ref.digest) {
+			return nil, fmt.Errorf("invalid digest %q in image reference %q", ref.digest, image)
+		}
+	}
+	if i := strings.LastIndex(ref.name, ":"); i > strings.LastIndex(ref.name, "/") {
+		ref.tag = ref.name[i+1:]
+		ref.name = ref.name[:i]
+		if !imageTagRegexp.MatchString(ref.tag) {
+			return nil, fmt.Errorf("invalid tag %q in image reference %q", ref.tag, image)
+		}
+	}
+
+	ref.registry = defaultImageRegistry
+	ref.repository = ref.name
+	if i := strings.Index(ref.name, "/"); i >= 0 {
+		host := ref.name[:i]
+		if strings.ContainsAny(host, ".:") || host == "localhost" {
+			ref.registry = host
+			ref.repository = ref.name[i+1:]
+		}
+	}
+	if ref.registry == defaultImageRegistry && !strings.Contains(ref.repository, "/") {
+		ref.repository = "library/" + ref.repository
+	}
+	for _, component := range strings.Split(ref.repository, "/") {
+		if !imagePathComponentRegexp.MatchString(component) {
+			return nil, fmt.Errorf("invalid repository %q in image reference %q", ref.repository, image)
+		}
+	}
+
+	return ref, nil
+}
+
+// validateImageDigest checks the image is a well-formed reference pinned by digest
+func validateImageDigest(image string) error {
+	ref, err := parseImageReference(image)
+	if err != nil {
+		return err
+	}
+	if ref.digest == "" {
+		return fmt.Errorf("image %q is not referenced by digest, expect <image>@sha256:<digest>", image)
+	}
+	return nil
+}
+
+// resolveImageDigest looks up the digest of the image tag in its registry with an
+// anonymous HEAD request on the manifest and returns the image pinned by digest
+func resolveImageDigest(image string) (string, error) {
+	ref, err := parseImageReference(image)
+	if err != nil {
+		return "", err
+	}
+	if ref.digest != "" {
+		return image, nil
+	}
+	tag := ref.tag
+	if tag == "" {
+		tag = "latest"
+	}
+
+	host := ref.registry
+	if host == defaultImageRegistry {
+		host = dockerHubRegistryHost
+	}
+	manifestURL := fmt.Sprintf("https://%s/v2/%s/manifests/%s", host, ref.repository, tag)
+
+	client := registryClient
+	resp, err := headManifest(client, manifestURL, "")
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		// registries such as docker hub require an anonymous bearer token even for public images
+		token, err := fetchAnonymousToken(client, resp.Header.Get("WWW-Authenticate"))
+		if err != nil {
+			return "", fmt.Errorf("failed to get anonymous token for %q: %v", image, err)
+		}
+		if resp, err = headManifest(client, manifestURL, token); err != nil {
+			return "", err
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to resolve %q: registry returned %s", image, resp.Status)
+	}
+
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if !imageDigestRegexp.MatchString(digest) {
+		return "", fmt.Errorf("failed to resolve %q: registry returned invalid digest %q", image, digest)
+	}
+
+	return ref.name + "@" + digest, nil
+}
+
+func headManifest(client *http.Client, manifestURL, token string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodHead, manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", strings.Join([]string{
+		"application/vnd.oci.image.index.v1+json",
+		"application/vnd.docker.distribution.manifest.list.v2+json",
+		"application/vnd.oci.image.manifest.v1+json",
+		"application/vnd.docker.distribution.manifest.v2+json",
+	}, ", "))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp, nil
+}
+
+func fetchAnonymousToken(client *http.Client, challenge string) (string, error) {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return "", fmt.Errorf("unsupported authentication challenge %q", challenge)
+	}
+	params := map[string]string{}
+	for _, match := range bearerParamRegexp.FindAllStringSubmatch(challenge, -1) {
+		params[match[1]] = match[2]
+	}
+	if params["realm"] == "" {
+		return "", fmt.Errorf("authentication challenge %q has no realm", challenge)
+	}
+
+	query := url.Values{}
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			query.Set(key, params[key])
+		}
+	}
+	resp, err := client.Get(params["realm"] + "?" + query.Encode())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+
+	var body struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", err
+	}
+	if body.Token != "" {
+		return body.Token, nil
+	}
+	return body.AccessToken, nil
+}
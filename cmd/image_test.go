@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestParseImageReference(t *testing.T) {
+	tests := []struct {
+		image   string
+		want    imageReference
+		wantErr bool
+	}{
+		{
+			image: "nginx",
+			want:  imageReference{name: "nginx", registry: "docker.io", repository: "library/nginx"},
+		},
+		{
+			image: "nginx:1.21",
+			want:  imageReference{name: "nginx", registry: "docker.io", repository: "library/nginx", tag: "1.21"},
+		},
+		{
+			image: "morvencao/sidecar-injector:latest",
+			want:  imageReference{name: "morvencao/sidecar-injector", registry: "docker.io", repository: "morvencao/sidecar-injector", tag: "latest"},
+		},
+		{
+			image: "localhost:5000/x",
+			want:  imageReference{name: "localhost:5000/x", registry: "localhost:5000", repository: "x"},
+		},
+		{
+			image: "localhost/x:v1",
+			want:  imageReference{name: "localhost/x", registry: "localhost", repository: "x", tag: "v1"},
+		},
+		{
+			image: "quay.io/org/app:v1@" + testDigest,
+			want:  imageReference{name: "quay.io/org/app", registry: "quay.io", repository: "org/app", tag: "v1", digest: testDigest},
+		},
+		{
+			image: "quay.io/org/app@" + testDigest,
+			want:  imageReference{name: "quay.io/org/app", registry: "quay.io", repository: "org/app", digest: testDigest},
+		},
+		{image: "", wantErr: true},
+		{image: " nginx", wantErr: true},
+		{image: "Nginx", wantErr: true},
+		{image: "quay.io/Org/app", wantErr: true},
+		{image: "nginx@sha256:abc", wantErr: true},
+		{image: "nginx@md5:" + strings.Repeat("a", 32), wantErr: true},
+		{image: "nginx:-bad", wantErr: true},
+		{image: "nginx:", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			got, err := parseImageReference(tt.image)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseImageReference(%q) = %+v, want error", tt.image, *got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseImageReference(%q) returned error: %v", tt.image, err)
+			}
+			if *got != tt.want {
+				t.Errorf("parseImageReference(%q) = %+v, want %+v", tt.image, *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateImageDigest(t *testing.T) {
+	tests := []struct {
+		image   string
+		wantErr bool
+	}{
+		{image: "nginx@" + testDigest},
+		{image: "quay.io/org/app:v1@" + testDigest},
+		{image: "nginx:1.21", wantErr: true},
+		{image: "nginx", wantErr: true},
+		{image: "nginx@sha256:abc", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.image, func(t *testing.T) {
+			err := validateImageDigest(tt.image)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("validateImageDigest(%q) error = %v, wantErr %v", tt.image, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// newTestRegistry serves a registry requiring an anonymous bearer token for the manifest of repo:tag
+func newTestRegistry(t *testing.T, repo, tag, digest string) *httptest.Server {
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			if got := r.URL.Query().Get("scope"); got != "repository:"+repo+":pull" {
+				t.Errorf("token scope = %q", got)
+			}
+			fmt.Fprint(w, `{"token": "anonymous"}`)
+		case "/v2/" + repo + "/manifests/" + tag:
+			if r.Method != http.MethodHead {
+				t.Errorf("manifest method = %s, want HEAD", r.Method)
+			}
+			if r.Header.Get("Authorization") != "Bearer anonymous" {
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry",scope="repository:%s:pull"`, srv.URL, repo))
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Docker-Content-Digest", digest)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	client := registryClient
+	registryClient = srv.Client()
+	t.Cleanup(func() { registryClient = client })
+	return srv
+}
+
+func TestResolveImageDigest(t *testing.T) {
+	srv := newTestRegistry(t, "org/app", "v1", testDigest)
+	host := strings.TrimPrefix(srv.URL, "https://")
+
+	got, err := resolveImageDigest(host + "/org/app:v1")
+	if err != nil {
+		t.Fatalf("resolveImageDigest returned error: %v", err)
+	}
+	if want := host + "/org/app@" + testDigest; got != want {
+		t.Errorf("resolveImageDigest = %q, want %q", got, want)
+	}
+
+	// images already pinned are returned as is without a registry request
+	pinned := host + "/org/other@" + testDigest
+	if got, err := resolveImageDigest(pinned); err != nil || got != pinned {
+		t.Errorf("resolveImageDigest(%q) = %q, %v, want it unchanged", pinned, got, err)
+	}
+
+	if _, err := resolveImageDigest(host + "/org/missing:v1"); err == nil {
+		t.Error("resolveImageDigest of a missing manifest returned no error")
+	}
+}
+
+func TestResolveImageDigestInvalidDigestHeader(t *testing.T) {
+	srv := newTestRegistry(t, "org/app", "v1", "sha256:not-a-digest")
+	host := strings.TrimPrefix(srv.URL, "https://")
+
+	if got, err := resolveImageDigest(host + "/org/app:v1"); err == nil {
+		t.Errorf("resolveImageDigest = %q, want an invalid digest error", got)
+	}
+}
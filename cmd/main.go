@@ -5,14 +5,21 @@ import (
 	"crypto/tls"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"path"
+	"strings"
 	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var (
+	debugLogger   *log.Logger
 	infoLogger    *log.Logger
 	warningLogger *log.Logger
 	errorLogger   *log.Logger
@@ -22,10 +29,28 @@ var (
 	port                                 int
 	sidecarConfigFile                    string
 	webhookNamespace, webhookServiceName string
+	requireImageDigest                   bool
+	resolveImageDigests                  bool
+	allowedImageRegistries               []string
+	requireCSIDriver                     bool
+	csiDriverCheckInterval               time.Duration
+	injectOnUpdate                       bool
+	debug                                bool
+	patchSizeWarningBytes                int
+	instanceName                         string
+	injectionMetricsSidecarLabel         bool
+	nameConflictPolicy                   string
+	sidecarInfoVolume                    bool
+	sidecarInfoPath                      string
+	ephemeralContainers                  bool
+	configEndpointTokenFile              string
+	configEndpointToken                  string
+	injectByDefault                      bool
 )
 
 func init() {
-	// init loggers
+	// init loggers, debug logs are enabled with the -debug flag
+	debugLogger = log.New(ioutil.Discard, "DEBUG: ", log.Ldate|log.Ltime|log.Lshortfile)
 	infoLogger = log.New(os.Stderr, "INFO: ", log.Ldate|log.Ltime|log.Lshortfile)
 	warningLogger = log.New(os.Stderr, "WARNING: ", log.Ldate|log.Ltime|log.Lshortfile)
 	errorLogger = log.New(os.Stderr, "ERROR: ", log.Ldate|log.Ltime|log.Lshortfile)
@@ -35,14 +60,75 @@ func init() {
 }
 
 func main() {
+	// subcommands, gen-config is an alias of gen-manifest
+	if len(os.Args) > 1 && (os.Args[1] == "gen-manifest" || os.Args[1] == "gen-config") {
+		if err := genManifest(os.Args[1], os.Args[2:], os.Stdout); err != nil {
+			errorLogger.Fatalf("Failed to generate the mutating webhook configuration manifest: %v", err)
+		}
+		return
+	}
+
 	// init command flags
 	flag.IntVar(&port, "port", 8443, "Webhook server port.")
 	flag.StringVar(&webhookServiceName, "service-name", "sidecar-injector", "Webhook service name.")
 	flag.StringVar(&sidecarConfigFile, "sidecar-config-file", "/etc/webhook/config/sidecarconfig.yaml", "Sidecar injector configuration file.")
+	flag.BoolVar(&requireImageDigest, "require-image-digest", false, "Require sidecar images to be referenced by digest.")
+	flag.BoolVar(&resolveImageDigests, "resolve-image-digest", false, "Resolve sidecar image tags to digests from the registry at startup.")
+	flag.Func("allowed-image-registries", "Comma-separated registries the per-pod sidecar image annotation may use.", func(value string) error {
+		for _, registry := range strings.Split(value, ",") {
+			if registry = strings.TrimSpace(registry); registry != "" {
+				allowedImageRegistries = append(allowedImageRegistries, registry)
+			}
+		}
+		return nil
+	})
+	flag.BoolVar(&requireCSIDriver, "require-csi-driver", false, "Refuse to start when a CSI driver used by the sidecar volumes is not installed, instead of admitting pods without sidecars.")
+	flag.DurationVar(&csiDriverCheckInterval, "csi-driver-check-interval", 5*time.Minute, "Interval to re-check that the CSI drivers used by the sidecar volumes are installed.")
+	flag.BoolVar(&injectOnUpdate, "inject-on-update", false, "Inject sidecars on pod UPDATE as well as CREATE.")
+	flag.BoolVar(&injectByDefault, "inject-by-default", true, "Inject pods whose inject annotation has an unrecognized value, the value is reported in a warning either way.")
+	flag.BoolVar(&debug, "debug", false, "Enable debug logging.")
+	flag.IntVar(&patchSizeWarningBytes, "patch-size-warning-bytes", 512*1024, "Log a warning when a generated patch is larger than this many bytes, 0 disables the warning.")
+	flag.StringVar(&instanceName, "instance-name", os.Getenv("POD_NAME"), "Name of this injector instance recorded on injected pods, defaults to $POD_NAME.")
+	flag.BoolVar(&injectionMetricsSidecarLabel, "injection-metrics-sidecar-label", true, "Label the injection counters by sidecar name, disable to reduce metric cardinality.")
+	flag.Func("namespace-selector", "Comma-separated key=value labels selecting the namespaces to inject, defaults to sidecar-injection=enabled.", func(value string) (err error) {
+		namespaceSelectorLabels, err = parseNamespaceSelector(value)
+		return err
+	})
+	flag.Func("webhook-path", "HTTP path the webhook is served at, defaults to /inject.", func(value string) (err error) {
+		webhookInjectPath, err = parseWebhookPath(value)
+		return err
+	})
+	flag.StringVar(&nameConflictPolicy, "name-conflict-policy", nameConflictPolicyRename, "What to do when the pod already has a container or volume named like a sidecar one: rename the sidecar one, or skip injection.")
+	flag.BoolVar(&sidecarInfoVolume, "sidecar-info-volume", false, "Mount a file listing the injected sidecars and their mount paths into the pod containers.")
+	flag.StringVar(&sidecarInfoPath, "sidecar-info-path", "/etc/sidecar-injector", "Directory the sidecars.json file is mounted at when -sidecar-info-volume is set.")
+	flag.BoolVar(&ephemeralContainers, "ephemeral-containers", false, "Mount the injected volumes into ephemeral containers added to injected pods, e.g. by kubectl debug. Requires Kubernetes v1.22+.")
+	flag.StringVar(&configEndpointTokenFile, "config-endpoint-token-file", "", "File holding the bearer token required by the /config endpoint, the endpoint is disabled when unset.")
 	// flag.StringVar(&certFile, "tlsCertFile", "/etc/webhook/certs/cert.pem", "x509 Certificate file.")
 	// flag.StringVar(&keyFile, "tlsKeyFile", "/etc/webhook/certs/key.pem", "x509 private key file.")
 	flag.Parse()
 
+	if debug {
+		debugLogger.SetOutput(os.Stderr)
+	}
+	if nameConflictPolicy != nameConflictPolicyRename && nameConflictPolicy != nameConflictPolicySkip {
+		errorLogger.Fatalf("Invalid -name-conflict-policy %q, expect %q or %q", nameConflictPolicy, nameConflictPolicyRename, nameConflictPolicySkip)
+	}
+	if csiDriverCheckInterval <= 0 {
+		errorLogger.Fatalf("Invalid -csi-driver-check-interval %v, expect a positive duration", csiDriverCheckInterval)
+	}
+	if !path.IsAbs(sidecarInfoPath) {
+		errorLogger.Fatalf("Invalid -sidecar-info-path %q, must be an absolute path", sidecarInfoPath)
+	}
+	if configEndpointTokenFile != "" {
+		data, err := ioutil.ReadFile(configEndpointTokenFile)
+		if err != nil {
+			errorLogger.Fatalf("Failed to read the config endpoint token: %v", err)
+		}
+		if configEndpointToken = strings.TrimSpace(string(data)); configEndpointToken == "" {
+			errorLogger.Fatalf("Config endpoint token file %s is empty", configEndpointTokenFile)
+		}
+	}
+
 	dnsNames := []string{
 		webhookServiceName,
 		webhookServiceName + "." + webhookNamespace,
@@ -66,23 +152,64 @@ func main() {
 		errorLogger.Fatalf("Failed to load configuration: %v", err)
 	}
 
+	clientset, err := newKubeClient()
+	if err != nil {
+		errorLogger.Fatalf("Failed to initialize the kube client: %v", err)
+	}
+
+	// check the CSI drivers used by the sidecar volumes are installed
+	csiDrivers := newCSIDriverChecker(clientset, sidecarConfig)
+	missing, err := csiDrivers.check(context.Background())
+	if err != nil {
+		if requireCSIDriver {
+			errorLogger.Fatalf("Failed to check CSI drivers: %v", err)
+		}
+		// a transient API error should not stop the injector, the drivers are checked again periodically
+		warningLogger.Printf("Failed to check CSI drivers, retrying in %v: %v", csiDriverCheckInterval, err)
+	}
+	if len(missing) > 0 {
+		if requireCSIDriver {
+			errorLogger.Fatalf("CSI drivers %v are not installed", missing)
+		}
+		warningLogger.Printf("CSI drivers %v are not installed, pods are admitted without sidecars", missing)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if len(csiDrivers.drivers) > 0 {
+		go csiDrivers.run(ctx, csiDriverCheckInterval)
+	}
+
+	// run a synthetic pod through the injection pipeline
+	selfTest := newSelfTest(clientset)
+	if err := selfTest.run(context.Background(), sidecarConfig); err != nil {
+		warningLogger.Printf("Self-test failed, reporting not ready: %v", err)
+	}
+
 	// create or update the mutatingwebhookconfiguration
-	err = createOrUpdateMutatingWebhookConfiguration(caPEM, webhookServiceName, webhookNamespace)
+	err = createOrUpdateMutatingWebhookConfiguration(clientset, caPEM, webhookServiceName, webhookNamespace)
 	if err != nil {
 		errorLogger.Fatalf("Failed to create or update the mutating webhook configuration: %v", err)
 	}
 
 	whsvr := &WebhookServer{
-		sidecarConfig: sidecarConfig,
+		csiDrivers: csiDrivers,
+		selfTest:   selfTest,
 		server: &http.Server{
 			Addr:      fmt.Sprintf(":%v", port),
 			TLSConfig: &tls.Config{Certificates: []tls.Certificate{pair}},
 		},
 	}
 
+	whsvr.setConfig(sidecarConfig)
+
 	// define http server and server handler
 	mux := http.NewServeMux()
 	mux.HandleFunc(webhookInjectPath, whsvr.serve)
+	mux.HandleFunc("/readyz", whsvr.serveReadyz)
+	mux.Handle("/metrics", promhttp.Handler())
+	if configEndpointToken != "" {
+		mux.HandleFunc("/config", whsvr.serveConfig)
+	}
 	whsvr.server.Handler = mux
 
 	// start webhook server in new rountine
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// genManifest writes the mutatingwebhookconfiguration the server would register to out,
+// so it can be applied with kubectl or managed with GitOps instead
+func genManifest(name string, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	serviceName := fs.String("service-name", "sidecar-injector", "Webhook service name.")
+	serviceNamespace := fs.String("service-namespace", "sidecar-injector", "Webhook service namespace.")
+	caBundleFile := fs.String("ca-bundle-file", "", "PEM encoded CA bundle file the webhook serving certificate is signed with.")
+	failurePolicy := fs.String("failure-policy", string(admissionregistrationv1.Fail), "Webhook failure policy, Fail or Ignore.")
+	reinvocationPolicy := fs.String("reinvocation-policy", string(admissionregistrationv1.NeverReinvocationPolicy), "Webhook reinvocation policy, Never or IfNeeded.")
+	fs.BoolVar(&injectOnUpdate, "inject-on-update", false, "Inject sidecars on pod UPDATE as well as CREATE.")
+	fs.BoolVar(&ephemeralContainers, "ephemeral-containers", false, "Also send pods/ephemeralcontainers updates to the webhook.")
+	fs.Func("namespace-selector", "Comma-separated key=value labels selecting the namespaces to inject, defaults to sidecar-injection=enabled.", func(value string) (err error) {
+		namespaceSelectorLabels, err = parseNamespaceSelector(value)
+		return err
+	})
+	fs.Func("webhook-path", "HTTP path the webhook is served at, defaults to /inject.", func(value string) (err error) {
+		webhookInjectPath, err = parseWebhookPath(value)
+		return err
+	})
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	switch admissionregistrationv1.FailurePolicyType(*failurePolicy) {
+	case admissionregistrationv1.Fail, admissionregistrationv1.Ignore:
+	default:
+		return fmt.Errorf("invalid failure policy %q, expect Fail or Ignore", *failurePolicy)
+	}
+	switch admissionregistrationv1.ReinvocationPolicyType(*reinvocationPolicy) {
+	case admissionregistrationv1.NeverReinvocationPolicy, admissionregistrationv1.IfNeededReinvocationPolicy:
+	default:
+		return fmt.Errorf("invalid reinvocation policy %q, expect Never or IfNeeded", *reinvocationPolicy)
+	}
+
+	var caBundle []byte
+	if *caBundleFile != "" {
+		data, err := ioutil.ReadFile(*caBundleFile)
+		if err != nil {
+			return err
+		}
+		caBundle = data
+	}
+
+	mutatingWebhookConfig := newMutatingWebhookConfiguration(caBundle, *serviceName, *serviceNamespace,
+		admissionregistrationv1.FailurePolicyType(*failurePolicy), admissionregistrationv1.ReinvocationPolicyType(*reinvocationPolicy))
+	data, err := yaml.Marshal(mutatingWebhookConfig)
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(data)
+	return err
+}
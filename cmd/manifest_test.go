@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// keepManifestFlags restores the flag variables genManifest sets when the test ends
+func keepManifestFlags(t *testing.T) {
+	oldInjectOnUpdate, oldEphemeralContainers := injectOnUpdate, ephemeralContainers
+	oldSelector, oldPath := namespaceSelectorLabels, webhookInjectPath
+	t.Cleanup(func() {
+		injectOnUpdate, ephemeralContainers = oldInjectOnUpdate, oldEphemeralContainers
+		namespaceSelectorLabels, webhookInjectPath = oldSelector, oldPath
+	})
+}
+
+func TestGenManifestGolden(t *testing.T) {
+	caBundleFile := filepath.Join("testdata", "manifest", "ca.pem")
+	tests := []struct {
+		name string
+		args []string
+	}{
+		{
+			name: "defaults",
+		},
+		{
+			name: "ca bundle",
+			args: []string{"-ca-bundle-file=" + caBundleFile},
+		},
+		{
+			name: "custom",
+			args: []string{
+				"-service-name=injector",
+				"-service-namespace=platform",
+				"-ca-bundle-file=" + caBundleFile,
+				"-failure-policy=Ignore",
+				"-reinvocation-policy=IfNeeded",
+				"-inject-on-update",
+				"-namespace-selector=team=data,sidecars=on",
+				"-webhook-path=/mutate/pods",
+			},
+		},
+		{
+			name: "ephemeral containers",
+			args: []string{"-ca-bundle-file=" + caBundleFile, "-ephemeral-containers"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keepManifestFlags(t)
+			var out bytes.Buffer
+			if err := genManifest("gen-manifest", tt.args, &out); err != nil {
+				t.Fatalf("genManifest returned error: %v", err)
+			}
+			checkGolden(t, filepath.Join("manifest", strings.ReplaceAll(tt.name, " ", "-")+".yaml"), out.Bytes())
+
+			// gen-config is an alias
+			keepManifestFlags(t)
+			var alias bytes.Buffer
+			if err := genManifest("gen-config", tt.args, &alias); err != nil {
+				t.Fatalf("genManifest returned error: %v", err)
+			}
+			if !bytes.Equal(alias.Bytes(), out.Bytes()) {
+				t.Errorf("gen-config output differs from gen-manifest:\n%s", alias.String())
+			}
+		})
+	}
+}
+
+func TestGenManifestInvalidFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{name: "failure policy", args: []string{"-failure-policy=Retry"}, wantErr: "invalid failure policy"},
+		{name: "reinvocation policy", args: []string{"-reinvocation-policy=Always"}, wantErr: "invalid reinvocation policy"},
+		{name: "ca bundle file", args: []string{"-ca-bundle-file=" + filepath.Join("testdata", "manifest", "missing.pem")}, wantErr: "missing.pem"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keepManifestFlags(t)
+			var out bytes.Buffer
+			err := genManifest("gen-manifest", tt.args, &out)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("genManifest = %v, want error containing %q", err, tt.wantErr)
+			}
+			if out.Len() != 0 {
+				t.Errorf("genManifest wrote %q on error", out.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	csiDriverPresent = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sidecar_injector_csi_driver_present",
+		Help: "Whether the CSI driver used by the sidecar volumes is installed (1) or missing (0).",
+	}, []string{"driver"})
+
+	admissionRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sidecar_injector_admission_requests_total",
+		Help: "Number of admission requests received, by operation.",
+	}, []string{"operation"})
+
+	sidecarInjectionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sidecar_injections_total",
+		Help: "Number of sidecars injected, by namespace and sidecar. The sidecar label is empty and pods are counted when -injection-metrics-sidecar-label=false.",
+	}, []string{"namespace", "sidecar"})
+
+	patchSizeBytes = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sidecar_injector_patch_size_bytes",
+		Help:    "Size of the generated JSON patches in bytes, by outcome.",
+		Buckets: prometheus.ExponentialBuckets(256, 4, 8),
+	}, []string{"outcome"})
+
+	patchOperations = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "sidecar_injector_patch_operations",
+		Help:    "Number of operations in the generated JSON patches, by outcome.",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+	}, []string{"outcome"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		csiDriverPresent,
+		admissionRequestsTotal,
+		sidecarInjectionsTotal,
+		patchSizeBytes,
+		patchOperations,
+	)
+}
+
+// observePatch records the size and operation count of a patch built by createPatch
+func observePatch(result *patchResult, err error) {
+	if err != nil {
+		patchOperations.WithLabelValues("failed").Observe(float64(result.operations))
+		return
+	}
+	patchSizeBytes.WithLabelValues("injected").Observe(float64(len(result.patch)))
+	patchOperations.WithLabelValues("injected").Observe(float64(result.operations))
+}
+
+// countInjection increments the injection counters of the namespace for the injected sidecars
+func countInjection(namespace string, sidecars []string) {
+	if !injectionMetricsSidecarLabel {
+		sidecarInjectionsTotal.WithLabelValues(namespace, "").Inc()
+		return
+	}
+	for _, name := range sidecars {
+		sidecarInjectionsTotal.WithLabelValues(namespace, name).Inc()
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// histogramSample returns the sample count and sum of the histogram for the outcome
+func histogramSample(t *testing.T, vec *prometheus.HistogramVec, outcome string) (uint64, float64) {
+	t.Helper()
+	var m dto.Metric
+	if err := vec.WithLabelValues(outcome).(prometheus.Metric).Write(&m); err != nil {
+		t.Fatal(err)
+	}
+	return m.GetHistogram().GetSampleCount(), m.GetHistogram().GetSampleSum()
+}
+
+// podReview returns the AdmissionReview body creating the pod
+func podReview(t *testing.T, pod *corev1.Pod) string {
+	t.Helper()
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       "uid",
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Namespace: pod.Namespace,
+			Name:      pod.Name,
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestServePatchMetrics(t *testing.T) {
+	old := patchSizeWarningBytes
+	patchSizeWarningBytes = 16 * 1024
+	t.Cleanup(func() { patchSizeWarningBytes = old })
+
+	tests := []struct {
+		name     string
+		sidecars int
+		warning  bool
+	}{
+		{name: "small", sidecars: 1},
+		{name: "huge", sidecars: 200, warning: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			warnings := captureLogger(t, &warningLogger)
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "test-ns"},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+			}
+			sizeCount, sizeSum := histogramSample(t, patchSizeBytes, "injected")
+			opsCount, opsSum := histogramSample(t, patchOperations, "injected")
+
+			_, review := serveReview(t, newTestWebhookServer(benchmarkConfig(tt.sidecars)), podReview(t, pod), "application/json")
+			if review == nil || !review.Response.Allowed {
+				t.Fatalf("serve did not admit the pod: %+v", review)
+			}
+			patch := review.Response.Patch
+			var ops []patchOperation
+			if err := json.Unmarshal(patch, &ops); err != nil {
+				t.Fatal(err)
+			}
+
+			count, sum := histogramSample(t, patchSizeBytes, "injected")
+			if count != sizeCount+1 || sum-sizeSum != float64(len(patch)) {
+				t.Errorf("patch size observed %d times with %v bytes, want once with %d bytes", count-sizeCount, sum-sizeSum, len(patch))
+			}
+			count, sum = histogramSample(t, patchOperations, "injected")
+			if count != opsCount+1 || sum-opsSum != float64(len(ops)) {
+				t.Errorf("patch operations observed %d times with %v operations, want once with %d", count-opsCount, sum-opsSum, len(ops))
+			}
+
+			logged := strings.Contains(warnings.String(), "over the 16384 bytes warning threshold")
+			if logged != tt.warning {
+				t.Errorf("patch of %d bytes logged the size warning: %v, want %v\n%s", len(patch), logged, tt.warning, warnings.String())
+			}
+		})
+	}
+}
+
+func TestPatchSizeWarningDisabled(t *testing.T) {
+	old := patchSizeWarningBytes
+	patchSizeWarningBytes = 0
+	t.Cleanup(func() { patchSizeWarningBytes = old })
+	warnings := captureLogger(t, &warningLogger)
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "test-ns"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+	}
+	mutatePod(t, newTestWebhookServer(benchmarkConfig(200)), pod, admissionv1.Create)
+	if warnings.Len() != 0 {
+		t.Errorf("logged %q with the size warning disabled", warnings.String())
+	}
+}
+
+func TestObservePatchFailed(t *testing.T) {
+	cfg := patchTestConfig()
+	cfg.ExtraPatches = []patchOperation{{Op: "add", Path: "/spec/containers/-", Value: map[string]string{"name": "late"}}}
+	injectedCount, _ := histogramSample(t, patchSizeBytes, "injected")
+	failedCount, failedSum := histogramSample(t, patchOperations, "failed")
+
+	raw, err := json.Marshal(patchTestPod())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := newTestWebhookServer(cfg).mutate(&admissionv1.AdmissionReview{Request: &admissionv1.AdmissionRequest{
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Namespace: "test-ns",
+		Operation: admissionv1.Create,
+		Object:    runtime.RawExtension{Raw: raw},
+	}})
+	if resp.Allowed {
+		t.Fatalf("mutate allowed a pod with an invalid patch: %s", resp.Patch)
+	}
+
+	if count, _ := histogramSample(t, patchSizeBytes, "injected"); count != injectedCount {
+		t.Errorf("patch size observed for a failed patch")
+	}
+	count, sum := histogramSample(t, patchOperations, "failed")
+	if count != failedCount+1 || sum == failedSum {
+		t.Errorf("failed patch operations observed %d times with %v operations, want once with the operation count", count-failedCount, sum-failedSum)
+	}
+}
+
+func TestCountInjection(t *testing.T) {
+	tests := []struct {
+		name         string
+		sidecarLabel bool
+		namespace    string
+		want         map[string]float64
+	}{
+		{
+			name:         "sidecar label",
+			sidecarLabel: true,
+			namespace:    "count-sidecars",
+			want:         map[string]float64{"sidecar": 1, "logger": 1, "": 0},
+		},
+		{
+			name:      "pods only",
+			namespace: "count-pods",
+			want:      map[string]float64{"sidecar": 0, "logger": 0, "": 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setBoolFlag(t, &injectionMetricsSidecarLabel, tt.sidecarLabel)
+			before := map[string]float64{}
+			for sidecar := range tt.want {
+				before[sidecar] = testutil.ToFloat64(sidecarInjectionsTotal.WithLabelValues(tt.namespace, sidecar))
+			}
+
+			countInjection(tt.namespace, []string{"sidecar", "logger"})
+
+			for sidecar, want := range tt.want {
+				got := testutil.ToFloat64(sidecarInjectionsTotal.WithLabelValues(tt.namespace, sidecar)) - before[sidecar]
+				if got != want {
+					t.Errorf("sidecar_injections_total{namespace=%q,sidecar=%q} increased by %v, want %v", tt.namespace, sidecar, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestMutateCountsInjection(t *testing.T) {
+	for _, sidecarLabel := range []bool{true, false} {
+		setBoolFlag(t, &injectionMetricsSidecarLabel, sidecarLabel)
+		namespace := "count-mutate-" + strconv.FormatBool(sidecarLabel)
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: namespace},
+			Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+		}
+		mutatePod(t, newTestWebhookServer(patchTestConfig()), pod, admissionv1.Create)
+
+		want := map[string]float64{"sidecar": 1, "logger": 1, "": 0}
+		if !sidecarLabel {
+			want = map[string]float64{"sidecar": 0, "logger": 0, "": 1}
+		}
+		for sidecar, n := range want {
+			if got := testutil.ToFloat64(sidecarInjectionsTotal.WithLabelValues(namespace, sidecar)); got != n {
+				t.Errorf("sidecar_injections_total{namespace=%q,sidecar=%q} = %v, want %v", namespace, sidecar, got, n)
+			}
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// selfTest runs a synthetic pod through the injection pipeline and checks the permissions
+// of the injector, so misconfigurations show up before a real pod fails
+type selfTest struct {
+	client kubernetes.Interface
+
+	// runMu serializes the runs, lastRun is only accessed with it held
+	runMu   sync.Mutex
+	lastRun time.Time
+
+	mu  sync.RWMutex
+	err error
+}
+
+// selfTestMinInterval rate limits the deep /readyz checks, each run creates access reviews
+// against the API server
+const selfTestMinInterval = 30 * time.Second
+
+func newSelfTest(client kubernetes.Interface) *selfTest {
+	return &selfTest{client: client}
+}
+
+// run runs the self-test and records the result reported on /readyz
+func (t *selfTest) run(ctx context.Context, cfg *Config) error {
+	t.runMu.Lock()
+	defer t.runMu.Unlock()
+	return t.runLocked(ctx, cfg)
+}
+
+// runCached runs the self-test unless it ran within the last minInterval, in which case
+// the recorded result is returned, concurrent callers wait for a single run
+func (t *selfTest) runCached(ctx context.Context, cfg *Config, minInterval time.Duration) error {
+	t.runMu.Lock()
+	defer t.runMu.Unlock()
+	if !t.lastRun.IsZero() && time.Since(t.lastRun) < minInterval {
+		return t.lastError()
+	}
+	return t.runLocked(ctx, cfg)
+}
+
+func (t *selfTest) runLocked(ctx context.Context, cfg *Config) error {
+	t.lastRun = time.Now()
+	err := runSelfTest(ctx, t.client, cfg)
+	t.mu.Lock()
+	t.err = err
+	t.mu.Unlock()
+	return err
+}
+
+// lastError returns the error of the last self-test run
+func (t *selfTest) lastError() error {
+	if t == nil {
+		return nil
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.err
+}
+
+func runSelfTest(ctx context.Context, client kubernetes.Interface, cfg *Config) error {
+	pod := &corev1.Pod{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Pod"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "sidecar-injector-self-test",
+			Namespace: "sidecar-injector-self-test",
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Image: "app"}},
+		},
+	}
+
+	if required, _ := mutationRequired(ignoredNamespaces, &pod.ObjectMeta); !required {
+		return fmt.Errorf("self-test stage %q failed: synthetic pod is not selected for injection", "mutation policy")
+	}
+
+	result, err := createPatch(pod, cfg, map[string]string{admissionWebhookAnnotationStatusKey: "injected"})
+	if err != nil {
+		return fmt.Errorf("self-test stage %q failed: %v", "create patch", err)
+	}
+
+	mutated, err := applyPatch(pod, result.patch)
+	if err != nil {
+		return fmt.Errorf("self-test stage %q failed: %v", "apply patch", err)
+	}
+
+	if err := validateMutatedPod(mutated, cfg); err != nil {
+		return fmt.Errorf("self-test stage %q failed: %v", "validate pod", err)
+	}
+
+	if err := checkPermissions(ctx, client, cfg); err != nil {
+		return fmt.Errorf("self-test stage %q failed: %v", "permissions", err)
+	}
+
+	return nil
+}
+
+// applyPatch applies the JSON patch to a copy of the pod
+func applyPatch(pod *corev1.Pod, patchBytes []byte) (*corev1.Pod, error) {
+	patch, err := jsonpatch.DecodePatch(patchBytes)
+	if err != nil {
+		return nil, err
+	}
+	podBytes, err := json.Marshal(pod)
+	if err != nil {
+		return nil, err
+	}
+	mutatedBytes, err := patch.Apply(podBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	var mutated corev1.Pod
+	if err := json.Unmarshal(mutatedBytes, &mutated); err != nil {
+		return nil, err
+	}
+	return &mutated, nil
+}
+
+// validateMutatedPod checks the sidecars were injected and the pod names and volume references are consistent
+func validateMutatedPod(pod *corev1.Pod, cfg *Config) error {
+	containers := map[string]bool{}
+	for _, c := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+		if containers[c.Name] {
+			return fmt.Errorf("duplicate container name %q", c.Name)
+		}
+		containers[c.Name] = true
+	}
+	for _, c := range cfg.Containers {
+		if !containers[c.Name] {
+			return fmt.Errorf("sidecar %q was not injected", c.Name)
+		}
+	}
+
+	volumes := map[string]bool{}
+	for _, v := range pod.Spec.Volumes {
+		if volumes[v.Name] {
+			return fmt.Errorf("duplicate volume name %q", v.Name)
+		}
+		volumes[v.Name] = true
+	}
+	for _, c := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+		for _, m := range c.VolumeMounts {
+			if !volumes[m.Name] {
+				return fmt.Errorf("container %q mounts volume %q which does not exist", c.Name, m.Name)
+			}
+		}
+	}
+
+	if pod.Annotations[admissionWebhookAnnotationStatusKey] != "injected" {
+		return fmt.Errorf("status annotation %s was not set", admissionWebhookAnnotationStatusKey)
+	}
+
+	return nil
+}
+
+// checkPermissions verifies the injector may manage its webhook configuration and check CSI drivers
+func checkPermissions(ctx context.Context, client kubernetes.Interface, cfg *Config) error {
+	attributes := []authorizationv1.ResourceAttributes{
+		{Group: "admissionregistration.k8s.io", Resource: "mutatingwebhookconfigurations", Verb: "get", Name: webhookConfigName},
+		{Group: "admissionregistration.k8s.io", Resource: "mutatingwebhookconfigurations", Verb: "create"},
+		{Group: "admissionregistration.k8s.io", Resource: "mutatingwebhookconfigurations", Verb: "update", Name: webhookConfigName},
+	}
+	for _, v := range cfg.Volumes {
+		if v.CSI != nil {
+			attributes = append(attributes, authorizationv1.ResourceAttributes{Group: "storage.k8s.io", Resource: "csidrivers", Verb: "get", Name: v.CSI.Driver})
+		}
+	}
+
+	for i := range attributes {
+		review, err := client.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{ResourceAttributes: &attributes[i]},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return err
+		}
+		if !review.Status.Allowed {
+			return fmt.Errorf("not allowed to %s %s.%s %s", attributes[i].Verb, attributes[i].Resource, attributes[i].Group, attributes[i].Name)
+		}
+	}
+	return nil
+}
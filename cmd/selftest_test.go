@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// accessReviewClient returns a fake clientset answering the SelfSubjectAccessReviews with
+// allowed, except for the denied resources
+func accessReviewClient(deniedResources ...string) *fake.Clientset {
+	client := fake.NewSimpleClientset()
+	client.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview).DeepCopy()
+		review.Status.Allowed = true
+		for _, resource := range deniedResources {
+			if review.Spec.ResourceAttributes.Resource == resource {
+				review.Status.Allowed = false
+			}
+		}
+		return true, review, nil
+	})
+	return client
+}
+
+func selfTestConfig() *Config {
+	return &Config{
+		Containers: []corev1.Container{{
+			Name:         "sidecar",
+			Image:        "sidecar",
+			VolumeMounts: []corev1.VolumeMount{{Name: "shared", MountPath: "/shared"}},
+		}},
+		Volumes: []corev1.Volume{
+			{Name: "shared", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}},
+			{Name: "secrets", VolumeSource: corev1.VolumeSource{CSI: &corev1.CSIVolumeSource{Driver: "secrets.csi.k8s.io"}}},
+		},
+	}
+}
+
+func TestRunSelfTest(t *testing.T) {
+	tests := []struct {
+		name    string
+		client  *fake.Clientset
+		config  func(cfg *Config)
+		wantErr string
+	}{
+		{
+			name:   "passes",
+			client: accessReviewClient(),
+		},
+		{
+			name:    "webhook configuration denied",
+			client:  accessReviewClient("mutatingwebhookconfigurations"),
+			wantErr: `self-test stage "permissions" failed: not allowed to get mutatingwebhookconfigurations.admissionregistration.k8s.io ` + webhookConfigName,
+		},
+		{
+			name:    "csi driver denied",
+			client:  accessReviewClient("csidrivers"),
+			wantErr: `self-test stage "permissions" failed: not allowed to get csidrivers.storage.k8s.io secrets.csi.k8s.io`,
+		},
+		{
+			// the fake clientset echoes the review back, which is not allowed
+			name:    "access reviews not answered",
+			client:  fake.NewSimpleClientset(),
+			wantErr: `self-test stage "permissions" failed: not allowed to`,
+		},
+		{
+			name:   "duplicate sidecar names",
+			client: accessReviewClient(),
+			config: func(cfg *Config) {
+				cfg.Containers = append(cfg.Containers, corev1.Container{Name: "sidecar", Image: "other"})
+			},
+			wantErr: `self-test stage "validate pod" failed: duplicate container name "sidecar"`,
+		},
+		{
+			name:   "sidecar named like the app",
+			client: accessReviewClient(),
+			config: func(cfg *Config) {
+				cfg.Containers[0].Name = "app"
+			},
+			wantErr: `self-test stage "validate pod" failed: duplicate container name "app"`,
+		},
+		{
+			name:   "duplicate volume names",
+			client: accessReviewClient(),
+			config: func(cfg *Config) {
+				cfg.Volumes = append(cfg.Volumes, corev1.Volume{Name: "shared"})
+			},
+			wantErr: `self-test stage "validate pod" failed: duplicate volume name "shared"`,
+		},
+		{
+			name:   "dangling mount",
+			client: accessReviewClient(),
+			config: func(cfg *Config) {
+				cfg.Containers[0].VolumeMounts = append(cfg.Containers[0].VolumeMounts, corev1.VolumeMount{Name: "missing", MountPath: "/missing"})
+			},
+			wantErr: `self-test stage "validate pod" failed: container "sidecar" mounts volume "missing" which does not exist`,
+		},
+		{
+			name:   "dangling app mount",
+			client: accessReviewClient(),
+			config: func(cfg *Config) {
+				cfg.appVolumeMounts = []corev1.VolumeMount{{Name: "missing", MountPath: "/missing"}}
+			},
+			wantErr: `self-test stage "validate pod" failed: container "app" mounts volume "missing" which does not exist`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := selfTestConfig()
+			if tt.config != nil {
+				tt.config(cfg)
+			}
+			err := runSelfTest(context.Background(), tt.client, cfg)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("runSelfTest returned error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+				t.Errorf("runSelfTest = %v, want error %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunSelfTestPermissionReviews(t *testing.T) {
+	client := accessReviewClient()
+	if err := runSelfTest(context.Background(), client, selfTestConfig()); err != nil {
+		t.Fatalf("runSelfTest returned error: %v", err)
+	}
+
+	var got []string
+	for _, action := range client.Actions() {
+		if action.GetVerb() != "create" || action.GetResource().Resource != "selfsubjectaccessreviews" {
+			continue
+		}
+		attributes := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview).Spec.ResourceAttributes
+		got = append(got, attributes.Verb+" "+attributes.Resource+" "+attributes.Name)
+	}
+	want := []string{
+		"get mutatingwebhookconfigurations " + webhookConfigName,
+		"create mutatingwebhookconfigurations ",
+		"update mutatingwebhookconfigurations " + webhookConfigName,
+		"get csidrivers secrets.csi.k8s.io",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("access reviews:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestRunSelfTestIgnoredNamespace(t *testing.T) {
+	old := ignoredNamespaces
+	ignoredNamespaces = append([]string{"sidecar-injector-self-test"}, old...)
+	t.Cleanup(func() { ignoredNamespaces = old })
+
+	err := runSelfTest(context.Background(), accessReviewClient(), selfTestConfig())
+	want := `self-test stage "mutation policy" failed: synthetic pod is not selected for injection`
+	if err == nil || err.Error() != want {
+		t.Errorf("runSelfTest = %v, want error %q", err, want)
+	}
+}
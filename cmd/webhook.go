@@ -1,19 +1,29 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"mime"
 	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
 
-	"gopkg.in/yaml.v2"
 	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
 )
 
 var (
@@ -28,13 +38,38 @@ var ignoredNamespaces = []string{
 }
 
 const (
-	admissionWebhookAnnotationInjectKey = "sidecar-injector-webhook.morven.me/inject"
-	admissionWebhookAnnotationStatusKey = "sidecar-injector-webhook.morven.me/status"
+	admissionWebhookAnnotationInjectKey         = "sidecar-injector-webhook.morven.me/inject"
+	admissionWebhookAnnotationStatusKey         = "sidecar-injector-webhook.morven.me/status"
+	admissionWebhookAnnotationImageKey          = "sidecar-injector-webhook.morven.me/sidecar-image"
+	admissionWebhookAnnotationEffectiveImageKey = "sidecar-injector-webhook.morven.me/injected-image"
+	admissionWebhookAnnotationInjectedByKey     = "sidecar-injector-webhook.morven.me/injected-by"
+	admissionWebhookAnnotationReadOnlyAllKey    = "sidecar-injector-webhook.morven.me/read-only-all"
+	admissionWebhookAnnotationSidecarsKey       = "sidecar-injector-webhook.morven.me/sidecars"
+	admissionWebhookAnnotationExcludeKey        = "sidecar-injector-webhook.morven.me/exclude-containers"
+	admissionWebhookAnnotationVolumesKey        = "sidecar-injector-webhook.morven.me/volumes"
+
+	sidecarCountLabelKey = "sidecar-injector-webhook.morven.me/sidecar-count"
 )
 
 type WebhookServer struct {
-	sidecarConfig *Config
+	// sidecarConfig holds the active *Config, a loaded config is never modified and is only
+	// replaced as a whole, see config
+	sidecarConfig atomic.Value
 	server        *http.Server
+	csiDrivers    *csiDriverChecker
+	selfTest      *selfTest
+}
+
+// config returns the active configuration. Handlers read it once and use that snapshot for the
+// whole request, so a single admission request always uses exactly one configuration version
+// even if it is replaced concurrently.
+func (whsvr *WebhookServer) config() *Config {
+	return whsvr.sidecarConfig.Load().(*Config)
+}
+
+// setConfig makes the configuration active for the requests received from now on
+func (whsvr *WebhookServer) setConfig(cfg *Config) {
+	whsvr.sidecarConfig.Store(cfg)
 }
 
 // Webhook Server parameters
@@ -45,14 +80,92 @@ type WhSvrParameters struct {
 	sidecarCfgFile string // path to sidecar injector configuration file
 }
 
+const (
+	containerPositionAppend  = "append"
+	containerPositionPrepend = "prepend"
+)
+
+const (
+	nameConflictPolicyRename = "rename"
+	nameConflictPolicySkip   = "skip"
+)
+
 type Config struct {
-	Containers []corev1.Container `yaml:"containers"`
-	Volumes    []corev1.Volume    `yaml:"volumes"`
+	Containers []corev1.Container `json:"containers"`
+	Volumes    []corev1.Volume    `json:"volumes"`
+	// ContainerPosition controls whether the sidecars are appended after or
+	// prepended before the pod containers, the first container is the one
+	// `kubectl logs` and `kubectl exec` default to. Defaults to append.
+	ContainerPosition string `json:"containerPosition"`
+	// ImagePullSecrets are added to the pod so the sidecar images can be pulled
+	// from a private registry, secrets already referenced by the pod are kept as is
+	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets"`
+	// MinTerminationGracePeriodSeconds raises the pod grace period on injection so the
+	// sidecars have time to shut down cleanly, a higher pod value is never lowered
+	MinTerminationGracePeriodSeconds *int64 `json:"minTerminationGracePeriodSeconds"`
+	// Proxy is set on the sidecars so they can reach external endpoints through an HTTP proxy
+	Proxy ProxyConfig `json:"proxy"`
+	// ScratchVolume is an emptyDir shared between the sidecars and the pod containers, off when unset
+	ScratchVolume *ScratchVolumeConfig `json:"scratchVolume"`
+	// Labels are merged into the pod labels on injection, e.g. for network policies to select injected pods
+	Labels map[string]string `json:"labels"`
+	// ReadinessGates are condition types added to the pod readiness gates, a sidecar is expected
+	// to set these conditions, e.g. once its mounts are live, so the pod is not ready before
+	ReadinessGates []string `json:"readinessGates"`
+	// ExtraPatches are raw JSON patch operations appended on injection, e.g. to set dnsConfig,
+	// they must not touch the paths the injector patches itself
+	ExtraPatches []patchOperation `json:"extraPatches"`
+	// StaticMounts are volumes added on every injection and mounted into the pod containers only,
+	// e.g. a shared read-only reference data PVC
+	StaticMounts []StaticMount `json:"staticMounts"`
+	// ServiceAccountToken is a projected service account token mounted into the sidecars, e.g. to
+	// authenticate to a storage gateway behind an OIDC proxy, off when unset
+	ServiceAccountToken *ServiceAccountTokenConfig `json:"serviceAccountToken"`
+
+	// appVolumeMounts are added to the pod containers on injection
+	appVolumeMounts []corev1.VolumeMount
+	// checksum is the sha256 of the configuration file
+	checksum string
+	// excludedContainers are pod containers the appVolumeMounts are not added to
+	excludedContainers map[string]bool
+}
+
+// ScratchVolumeConfig describes the shared scratch emptyDir volume
+type ScratchVolumeConfig struct {
+	Name      string `json:"name"`      // volume name, defaults to sidecar-scratch
+	MountPath string `json:"mountPath"` // mount path in both the sidecars and the pod containers
+	SizeLimit string `json:"sizeLimit"` // optional emptyDir size limit as a resource quantity
 }
 
+// ServiceAccountTokenConfig describes the projected service account token volume of the sidecars
+type ServiceAccountTokenConfig struct {
+	Name              string `json:"name"`              // volume name, defaults to sidecar-token
+	Audience          string `json:"audience"`          // intended audience of the token, defaults to the API server
+	ExpirationSeconds *int64 `json:"expirationSeconds"` // requested token lifetime, at least 600
+	MountPath         string `json:"mountPath"`         // mount directory in the sidecars
+	EnvName           string `json:"envName"`           // env variable set to the token file path, defaults to SERVICE_ACCOUNT_TOKEN_FILE
+}
+
+// StaticMount describes a volume added to the pod and mounted into the pod containers
+type StaticMount struct {
+	Volume    corev1.Volume `json:"volume"`
+	MountPath string        `json:"mountPath"`
+	SubPath   string        `json:"subPath"`
+	ReadOnly  bool          `json:"readOnly"`
+}
+
+// ProxyConfig holds the proxy environment of the injected sidecars, unset values are not added
+type ProxyConfig struct {
+	HTTPProxy  string `json:"httpProxy"`
+	HTTPSProxy string `json:"httpsProxy"`
+	NoProxy    string `json:"noProxy"`
+}
+
+// patchOperation is a RFC 6902 operation, Value may point into the config as patches are only marshalled
 type patchOperation struct {
 	Op    string      `json:"op"`
 	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
 	Value interface{} `json:"value,omitempty"`
 }
 
@@ -61,23 +174,407 @@ func loadConfig(configFile string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
-	infoLogger.Printf("New configuration: sha256sum %x", sha256.Sum256(data))
+	checksum := fmt.Sprintf("%x", sha256.Sum256(data))
+	infoLogger.Printf("New configuration: sha256sum %s", checksum)
 
-	var cfg Config
+	cfg := Config{checksum: checksum}
 	if err := yaml.Unmarshal(data, &cfg); err != nil {
 		return nil, err
 	}
+	if resolveImageDigests {
+		if err := cfg.pinImageDigests(); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	cfg.setProxyEnv()
+	cfg.setScratchVolume()
+	cfg.setStaticMounts()
+	cfg.setServiceAccountToken()
 
 	return &cfg, nil
 }
 
-// Check whether the target resoured need to be mutated
-func mutationRequired(ignoredList []string, metadata *metav1.ObjectMeta) bool {
+// Validate checks the sidecar injector configuration and fills in defaults
+func (cfg *Config) Validate() error {
+	switch cfg.ContainerPosition {
+	case "":
+		cfg.ContainerPosition = containerPositionAppend
+	case containerPositionAppend, containerPositionPrepend:
+	default:
+		return fmt.Errorf("invalid containerPosition %q, expect %q or %q", cfg.ContainerPosition, containerPositionAppend, containerPositionPrepend)
+	}
+
+	if sv := cfg.ScratchVolume; sv != nil {
+		if sv.Name == "" {
+			sv.Name = "sidecar-scratch"
+		}
+		if !path.IsAbs(sv.MountPath) {
+			return fmt.Errorf("scratchVolume mountPath %q must be an absolute path", sv.MountPath)
+		}
+		if sv.SizeLimit != "" {
+			if _, err := resource.ParseQuantity(sv.SizeLimit); err != nil {
+				return fmt.Errorf("invalid scratchVolume sizeLimit %q: %v", sv.SizeLimit, err)
+			}
+		}
+	}
+
+	if sat := cfg.ServiceAccountToken; sat != nil {
+		if sat.Name == "" {
+			sat.Name = "sidecar-token"
+		}
+		if sat.EnvName == "" {
+			sat.EnvName = "SERVICE_ACCOUNT_TOKEN_FILE"
+		}
+		if !path.IsAbs(sat.MountPath) {
+			return fmt.Errorf("serviceAccountToken mountPath %q must be an absolute path", sat.MountPath)
+		}
+		if sat.ExpirationSeconds != nil && *sat.ExpirationSeconds < 600 {
+			return fmt.Errorf("serviceAccountToken expirationSeconds must be at least 600")
+		}
+		if errs := validation.IsEnvVarName(sat.EnvName); len(errs) > 0 {
+			return fmt.Errorf("invalid serviceAccountToken envName %q: %s", sat.EnvName, strings.Join(errs, "; "))
+		}
+	}
+
+	volumeNames := map[string]bool{}
+	for _, v := range cfg.Volumes {
+		volumeNames[v.Name] = true
+	}
+	if cfg.ScratchVolume != nil {
+		if volumeNames[cfg.ScratchVolume.Name] {
+			return fmt.Errorf("scratchVolume: duplicate volume name %q", cfg.ScratchVolume.Name)
+		}
+		volumeNames[cfg.ScratchVolume.Name] = true
+	}
+	if cfg.ServiceAccountToken != nil {
+		if volumeNames[cfg.ServiceAccountToken.Name] {
+			return fmt.Errorf("serviceAccountToken: duplicate volume name %q", cfg.ServiceAccountToken.Name)
+		}
+		volumeNames[cfg.ServiceAccountToken.Name] = true
+	}
+	for i, sm := range cfg.StaticMounts {
+		if errs := validation.IsDNS1123Label(sm.Volume.Name); len(errs) > 0 {
+			return fmt.Errorf("staticMounts[%d]: invalid volume name %q: %s", i, sm.Volume.Name, strings.Join(errs, "; "))
+		}
+		if volumeNames[sm.Volume.Name] {
+			return fmt.Errorf("staticMounts[%d]: duplicate volume name %q", i, sm.Volume.Name)
+		}
+		volumeNames[sm.Volume.Name] = true
+		if !path.IsAbs(sm.MountPath) {
+			return fmt.Errorf("staticMounts[%d]: mountPath %q must be an absolute path", i, sm.MountPath)
+		}
+	}
+
+	for key, value := range cfg.Labels {
+		if errs := validation.IsQualifiedName(key); len(errs) > 0 {
+			return fmt.Errorf("invalid label key %q: %s", key, strings.Join(errs, "; "))
+		}
+		if errs := validation.IsValidLabelValue(value); len(errs) > 0 {
+			return fmt.Errorf("invalid value %q of label %q: %s", value, key, strings.Join(errs, "; "))
+		}
+	}
+
+	for _, conditionType := range cfg.ReadinessGates {
+		if errs := validation.IsQualifiedName(conditionType); len(errs) > 0 {
+			return fmt.Errorf("invalid readiness gate condition type %q: %s", conditionType, strings.Join(errs, "; "))
+		}
+	}
+
+	for i := range cfg.ExtraPatches {
+		if err := validateExtraPatch(&cfg.ExtraPatches[i]); err != nil {
+			return fmt.Errorf("extraPatches[%d]: %v", i, err)
+		}
+	}
+
+	if cfg.MinTerminationGracePeriodSeconds != nil && *cfg.MinTerminationGracePeriodSeconds < 0 {
+		return fmt.Errorf("minTerminationGracePeriodSeconds must not be negative")
+	}
+
+	for _, secret := range cfg.ImagePullSecrets {
+		if secret.Name == "" {
+			return fmt.Errorf("imagePullSecrets entries must have a name")
+		}
+	}
+
+	if requireImageDigest {
+		for _, c := range cfg.Containers {
+			if err := validateImageDigest(c.Image); err != nil {
+				return fmt.Errorf("container %q: %v", c.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// generatedPatchPaths are patched by the injector, extra patches must stay clear of them
+var generatedPatchPaths = []string{
+	"/spec/containers",
+	"/spec/volumes",
+	"/spec/imagePullSecrets",
+	"/spec/readinessGates",
+	"/spec/terminationGracePeriodSeconds",
+	"/metadata/annotations",
+	"/metadata/labels",
+}
+
+// validateExtraPatch checks the operation is a valid RFC 6902 operation that does not conflict
+// with the generated ones
+func validateExtraPatch(op *patchOperation) error {
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.Value == nil {
+			return fmt.Errorf("%s operation needs a value", op.Op)
+		}
+	case "remove":
+	case "move", "copy":
+		if !strings.HasPrefix(op.From, "/") {
+			return fmt.Errorf("%s operation needs a from path starting with /", op.Op)
+		}
+	default:
+		return fmt.Errorf("invalid op %q", op.Op)
+	}
+
+	paths := []string{op.Path}
+	if op.From != "" {
+		paths = append(paths, op.From)
+	}
+	for _, p := range paths {
+		if !strings.HasPrefix(p, "/") {
+			return fmt.Errorf("path %q must start with /", p)
+		}
+		for _, generated := range generatedPatchPaths {
+			if p == generated || strings.HasPrefix(p, generated+"/") || strings.HasPrefix(generated, p+"/") {
+				return fmt.Errorf("path %q conflicts with the patched %s", p, generated)
+			}
+		}
+	}
+
+	return nil
+}
+
+// setProxyEnv adds the proxy environment variables to the sidecars,
+// variables the sidecar template already defines take precedence
+func (cfg *Config) setProxyEnv() {
+	proxyEnv := []corev1.EnvVar{
+		{Name: "HTTP_PROXY", Value: cfg.Proxy.HTTPProxy},
+		{Name: "HTTPS_PROXY", Value: cfg.Proxy.HTTPSProxy},
+		{Name: "NO_PROXY", Value: cfg.Proxy.NoProxy},
+	}
+	for i := range cfg.Containers {
+		c := &cfg.Containers[i]
+		for _, env := range proxyEnv {
+			if env.Value == "" || hasEnv(c.Env, env.Name) {
+				continue
+			}
+			c.Env = append(c.Env, env)
+		}
+	}
+}
+
+const redactedValue = "REDACTED"
+
+// redacted returns a copy of the config safe to expose for debugging, literal env values of the
+// sidecars and proxy credentials are replaced as they may carry secrets
+func (cfg *Config) redacted() *Config {
+	out := *cfg
+	out.Containers = make([]corev1.Container, len(cfg.Containers))
+	for i := range cfg.Containers {
+		cfg.Containers[i].DeepCopyInto(&out.Containers[i])
+	}
+	redactEnv(out.Containers)
+	out.Proxy.HTTPProxy = redactURLPassword(cfg.Proxy.HTTPProxy)
+	out.Proxy.HTTPSProxy = redactURLPassword(cfg.Proxy.HTTPSProxy)
+	return &out
+}
+
+// redactEnv replaces the literal env values of the containers, values from secret or config map
+// references are kept as they only name the reference
+func redactEnv(containers []corev1.Container) {
+	for i := range containers {
+		for j := range containers[i].Env {
+			if containers[i].Env[j].Value != "" {
+				containers[i].Env[j].Value = redactedValue
+			}
+		}
+	}
+}
+
+// redactPatchEnv replaces the literal env values the patch operations add, e.g. in the sidecar
+// containers, for the debug log of the patch
+func redactPatchEnv(patchBytes []byte) ([]byte, error) {
+	var ops []map[string]interface{}
+	if err := json.Unmarshal(patchBytes, &ops); err != nil {
+		return nil, err
+	}
+	for _, op := range ops {
+		path, _ := op["path"].(string)
+		switch value := op["value"].(type) {
+		case nil:
+		case []interface{}:
+			if strings.HasSuffix(path, "/env") {
+				redactEnvVars(value)
+			} else {
+				redactEnvFields(value)
+			}
+		case map[string]interface{}:
+			if strings.Contains(path, "/env/") {
+				redactEnvVars([]interface{}{value})
+			} else {
+				redactEnvFields(value)
+			}
+		}
+	}
+	return json.Marshal(ops)
+}
+
+// redactEnvFields redacts the env lists found in the decoded JSON value
+func redactEnvFields(value interface{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if env, ok := field.([]interface{}); ok && key == "env" {
+				redactEnvVars(env)
+			} else {
+				redactEnvFields(field)
+			}
+		}
+	case []interface{}:
+		for _, item := range v {
+			redactEnvFields(item)
+		}
+	}
+}
+
+func redactEnvVars(env []interface{}) {
+	for _, item := range env {
+		if envVar, ok := item.(map[string]interface{}); ok {
+			if value, ok := envVar["value"].(string); ok && value != "" {
+				envVar["value"] = redactedValue
+			}
+		}
+	}
+}
+
+func redactURLPassword(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	if _, ok := u.User.Password(); !ok {
+		return rawURL
+	}
+	u.User = url.UserPassword(u.User.Username(), redactedValue)
+	return u.String()
+}
+
+func hasEnv(envs []corev1.EnvVar, name string) bool {
+	for _, env := range envs {
+		if env.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// setScratchVolume adds the scratch emptyDir to the sidecar volumes and mounts it into the sidecars,
+// the mount into the pod containers is added on injection
+func (cfg *Config) setScratchVolume() {
+	sv := cfg.ScratchVolume
+	if sv == nil {
+		return
+	}
+
+	emptyDir := &corev1.EmptyDirVolumeSource{}
+	if sv.SizeLimit != "" {
+		sizeLimit := resource.MustParse(sv.SizeLimit)
+		emptyDir.SizeLimit = &sizeLimit
+	}
+	cfg.Volumes = append(cfg.Volumes, corev1.Volume{
+		Name:         sv.Name,
+		VolumeSource: corev1.VolumeSource{EmptyDir: emptyDir},
+	})
+
+	mount := corev1.VolumeMount{Name: sv.Name, MountPath: sv.MountPath}
+	for i := range cfg.Containers {
+		cfg.Containers[i].VolumeMounts = append(cfg.Containers[i].VolumeMounts, mount)
+	}
+	cfg.appVolumeMounts = append(cfg.appVolumeMounts, mount)
+}
+
+// setStaticMounts adds the static volumes to the sidecar volumes, they are mounted into the
+// pod containers on injection
+func (cfg *Config) setStaticMounts() {
+	for _, sm := range cfg.StaticMounts {
+		cfg.Volumes = append(cfg.Volumes, sm.Volume)
+		cfg.appVolumeMounts = append(cfg.appVolumeMounts, corev1.VolumeMount{
+			Name:      sm.Volume.Name,
+			MountPath: sm.MountPath,
+			SubPath:   sm.SubPath,
+			ReadOnly:  sm.ReadOnly,
+		})
+	}
+}
+
+// setServiceAccountToken adds the projected token volume to the sidecar volumes, mounts it read-only
+// into the sidecars and points the env variable at the token file, sidecars already defining it keep theirs
+func (cfg *Config) setServiceAccountToken() {
+	sat := cfg.ServiceAccountToken
+	if sat == nil {
+		return
+	}
+
+	cfg.Volumes = append(cfg.Volumes, corev1.Volume{
+		Name: sat.Name,
+		VolumeSource: corev1.VolumeSource{
+			Projected: &corev1.ProjectedVolumeSource{
+				Sources: []corev1.VolumeProjection{{
+					ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+						Audience:          sat.Audience,
+						ExpirationSeconds: sat.ExpirationSeconds,
+						Path:              "token",
+					},
+				}},
+			},
+		},
+	})
+
+	mount := corev1.VolumeMount{Name: sat.Name, MountPath: sat.MountPath, ReadOnly: true}
+	env := corev1.EnvVar{Name: sat.EnvName, Value: path.Join(sat.MountPath, "token")}
+	for i := range cfg.Containers {
+		c := &cfg.Containers[i]
+		c.VolumeMounts = append(c.VolumeMounts, mount)
+		if !hasEnv(c.Env, env.Name) {
+			c.Env = append(c.Env, env)
+		}
+	}
+}
+
+// pinImageDigests rewrites the sidecar images referenced by tag to their current digest
+func (cfg *Config) pinImageDigests() error {
+	for i, c := range cfg.Containers {
+		image, err := resolveImageDigest(c.Image)
+		if err != nil {
+			return fmt.Errorf("container %q: %v", c.Name, err)
+		}
+		if image != c.Image {
+			infoLogger.Printf("Pinned image of container %s: %s -> %s", c.Name, c.Image, image)
+			cfg.Containers[i].Image = image
+		}
+	}
+	return nil
+}
+
+// Check whether the target resoured need to be mutated, a non-empty warning reports an unrecognized inject annotation value
+func mutationRequired(ignoredList []string, metadata *metav1.ObjectMeta) (bool, string) {
 	// skip special kubernete system namespaces
 	for _, namespace := range ignoredList {
 		if metadata.Namespace == namespace {
 			infoLogger.Printf("Skip mutation for %v for it's in special namespace:%v", metadata.Name, metadata.Namespace)
-			return false
+			return false, ""
 		}
 	}
 
@@ -90,30 +587,417 @@ func mutationRequired(ignoredList []string, metadata *metav1.ObjectMeta) bool {
 
 	// determine whether to perform mutation based on annotation for the target resource
 	var required bool
+	var warning string
 	if strings.ToLower(status) == "injected" {
 		required = false
 	} else {
-		switch strings.ToLower(annotations[admissionWebhookAnnotationInjectKey]) {
-		default:
+		inject := annotations[admissionWebhookAnnotationInjectKey]
+		if strings.TrimSpace(inject) == "" {
 			required = true
-		case "n", "not", "false", "off":
-			required = false
+		} else if value, ok := parseAnnotationBool(inject); ok {
+			required = value
+		} else {
+			required = injectByDefault
+			warning = fmt.Sprintf("unrecognized %s annotation value %q, expect yes or no, sidecars injected: %v", admissionWebhookAnnotationInjectKey, inject, required)
+			warningLogger.Printf("Mutation policy for %v/%v: %s", metadata.Namespace, metadata.Name, warning)
 		}
 	}
 
 	infoLogger.Printf("Mutation policy for %v/%v: status: %q required:%v", metadata.Namespace, metadata.Name, status, required)
-	return required
+	return required, warning
+}
+
+// parseAnnotationBool parses a yes or no annotation value, case and surrounding whitespace are
+// ignored, ok is false for an unrecognized value
+func parseAnnotationBool(value string) (b bool, ok bool) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "y", "yes", "true", "on":
+		return true, true
+	case "n", "no", "not", "false", "off":
+		return false, true
+	}
+	return false, false
+}
+
+// sidecarImageOverride returns the sidecar image requested by the pod annotation, or "" to keep
+// the configured images. An error is returned if the requested image is malformed or not allowed.
+func sidecarImageOverride(metadata *metav1.ObjectMeta) (string, error) {
+	image, ok := metadata.GetAnnotations()[admissionWebhookAnnotationImageKey]
+	if !ok {
+		return "", nil
+	}
+
+	ref, err := parseImageReference(image)
+	if err != nil {
+		return "", err
+	}
+	allowed := false
+	for _, registry := range allowedImageRegistries {
+		if ref.registry == registry {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return "", fmt.Errorf("registry %q of image %q is not allowed", ref.registry, image)
+	}
+	if requireImageDigest && ref.digest == "" {
+		return "", fmt.Errorf("image %q is not referenced by digest", image)
+	}
+
+	return image, nil
+}
+
+// withSidecarImage returns a copy of the config with all sidecar images replaced
+func (cfg *Config) withSidecarImage(image string) *Config {
+	out := *cfg
+	out.Containers = make([]corev1.Container, len(cfg.Containers))
+	for i := range cfg.Containers {
+		cfg.Containers[i].DeepCopyInto(&out.Containers[i])
+		out.Containers[i].Image = image
+	}
+	return &out
+}
+
+// withReadOnlyMounts returns a copy of the config mounting the injected volumes read-only into the
+// pod containers, the sidecars keep their own mounts as they may need to write, e.g. to the scratch volume
+func (cfg *Config) withReadOnlyMounts() *Config {
+	out := *cfg
+	out.appVolumeMounts = make([]corev1.VolumeMount, len(cfg.appVolumeMounts))
+	for i := range cfg.appVolumeMounts {
+		out.appVolumeMounts[i] = cfg.appVolumeMounts[i]
+		out.appVolumeMounts[i].ReadOnly = true
+	}
+	return &out
+}
+
+// withExcludedContainers returns a copy of the config that does not mount the injected volumes
+// into the named pod containers
+func (cfg *Config) withExcludedContainers(names []string) *Config {
+	out := *cfg
+	out.excludedContainers = map[string]bool{}
+	for _, name := range names {
+		out.excludedContainers[name] = true
+	}
+	return &out
+}
+
+// resolveNameConflicts checks the sidecar container and volume names against the pod, a clash
+// is renamed with the first free -<n> suffix or returned as an error, depending on -name-conflict-policy
+func (cfg *Config) resolveNameConflicts(pod *corev1.Pod) (*Config, []string, error) {
+	usedContainers := map[string]bool{}
+	for _, c := range pod.Spec.InitContainers {
+		usedContainers[c.Name] = true
+	}
+	for _, c := range pod.Spec.Containers {
+		usedContainers[c.Name] = true
+	}
+	usedVolumes := map[string]bool{}
+	for _, v := range pod.Spec.Volumes {
+		usedVolumes[v.Name] = true
+	}
+
+	var clashes []string
+	for _, c := range cfg.Containers {
+		if usedContainers[c.Name] {
+			clashes = append(clashes, "container "+c.Name)
+		}
+	}
+	for _, v := range cfg.Volumes {
+		if usedVolumes[v.Name] {
+			clashes = append(clashes, "volume "+v.Name)
+		}
+	}
+	if len(clashes) == 0 {
+		return cfg, nil, nil
+	}
+	if nameConflictPolicy != nameConflictPolicyRename {
+		return nil, nil, fmt.Errorf("pod already has %s", strings.Join(clashes, ", "))
+	}
+
+	out := *cfg
+	out.Containers = make([]corev1.Container, len(cfg.Containers))
+	for i := range cfg.Containers {
+		cfg.Containers[i].DeepCopyInto(&out.Containers[i])
+	}
+	out.Volumes = make([]corev1.Volume, len(cfg.Volumes))
+	for i := range cfg.Volumes {
+		cfg.Volumes[i].DeepCopyInto(&out.Volumes[i])
+	}
+	out.appVolumeMounts = append([]corev1.VolumeMount(nil), cfg.appVolumeMounts...)
+
+	// names of the other sidecars are taken as well
+	for _, c := range cfg.Containers {
+		usedContainers[c.Name] = true
+	}
+	for _, v := range cfg.Volumes {
+		usedVolumes[v.Name] = true
+	}
+
+	var renamed []string
+	for i := range out.Containers {
+		c := &out.Containers[i]
+		if !hasContainer(pod.Spec.InitContainers, c.Name) && !hasContainer(pod.Spec.Containers, c.Name) {
+			continue
+		}
+		name := uniqueName(c.Name, usedContainers)
+		renamed = append(renamed, fmt.Sprintf("container %s to %s", c.Name, name))
+		c.Name = name
+	}
+	for i := range out.Volumes {
+		v := &out.Volumes[i]
+		if !hasVolume(pod.Spec.Volumes, v.Name) {
+			continue
+		}
+		name := uniqueName(v.Name, usedVolumes)
+		renamed = append(renamed, fmt.Sprintf("volume %s to %s", v.Name, name))
+		for j := range out.Containers {
+			renameVolumeMounts(out.Containers[j].VolumeMounts, v.Name, name)
+		}
+		renameVolumeMounts(out.appVolumeMounts, v.Name, name)
+		v.Name = name
+	}
+
+	return &out, renamed, nil
+}
+
+// uniqueName returns the name with the first -<n> suffix not used yet, and marks it used
+func uniqueName(name string, used map[string]bool) string {
+	for n := 2; ; n++ {
+		suffix := "-" + strconv.Itoa(n)
+		base := name
+		// keep the result a valid DNS label
+		if len(base)+len(suffix) > validation.DNS1123LabelMaxLength {
+			base = strings.TrimRight(base[:validation.DNS1123LabelMaxLength-len(suffix)], "-")
+		}
+		if candidate := base + suffix; !used[candidate] {
+			used[candidate] = true
+			return candidate
+		}
+	}
+}
+
+func hasContainer(containers []corev1.Container, name string) bool {
+	for _, c := range containers {
+		if c.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func hasVolume(volumes []corev1.Volume, name string) bool {
+	for _, v := range volumes {
+		if v.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func renameVolumeMounts(mounts []corev1.VolumeMount, from, to string) {
+	for i := range mounts {
+		if mounts[i].Name == from {
+			mounts[i].Name = to
+		}
+	}
+}
+
+const (
+	sidecarInfoVolumeName = "sidecar-injector-info"
+	sidecarInfoFileName   = "sidecars.json"
+	// keep well below the 256KiB total annotation size limit of a pod
+	sidecarInfoMaxBytes = 32 * 1024
+)
+
+// sidecarInfo describes an injected sidecar for the pod containers
+type sidecarInfo struct {
+	Name       string   `json:"name"`
+	Image      string   `json:"image"`
+	MountPaths []string `json:"mountPaths,omitempty"`
+}
+
+// withSidecarInfoVolume returns a copy of the config that also injects a downward API volume
+// exposing the sidecars annotation to the pod containers as a file
+func (cfg *Config) withSidecarInfoVolume() *Config {
+	out := *cfg
+	out.Volumes = append(append([]corev1.Volume(nil), cfg.Volumes...), corev1.Volume{
+		Name: sidecarInfoVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			DownwardAPI: &corev1.DownwardAPIVolumeSource{
+				Items: []corev1.DownwardAPIVolumeFile{{
+					Path: sidecarInfoFileName,
+					FieldRef: &corev1.ObjectFieldSelector{
+						FieldPath: fmt.Sprintf("metadata.annotations['%s']", admissionWebhookAnnotationSidecarsKey),
+					},
+				}},
+			},
+		},
+	})
+	out.appVolumeMounts = append(append([]corev1.VolumeMount(nil), cfg.appVolumeMounts...), corev1.VolumeMount{
+		Name:      sidecarInfoVolumeName,
+		MountPath: sidecarInfoPath,
+		ReadOnly:  true,
+	})
+	return &out
+}
+
+// sidecarsAnnotation lists the injected sidecars with their mount paths as JSON
+func (cfg *Config) sidecarsAnnotation() (string, error) {
+	infos := make([]sidecarInfo, 0, len(cfg.Containers))
+	for _, c := range cfg.Containers {
+		info := sidecarInfo{Name: c.Name, Image: c.Image}
+		for _, m := range c.VolumeMounts {
+			info.MountPaths = append(info.MountPaths, m.MountPath)
+		}
+		infos = append(infos, info)
+	}
+	data, err := json.Marshal(infos)
+	return string(data), err
+}
+
+// staleInjectionStatus reports whether the pod is annotated as injected but has none of the
+// sidecars recorded in its sidecars annotation, or configured when it has none, e.g. a pod
+// recreated from a template that copied the annotations of an injected pod
+func staleInjectionStatus(pod *corev1.Pod, cfg *Config) bool {
+	if strings.ToLower(pod.Annotations[admissionWebhookAnnotationStatusKey]) != "injected" {
+		return false
+	}
+
+	var names []string
+	if data, ok := pod.Annotations[admissionWebhookAnnotationSidecarsKey]; ok {
+		var infos []sidecarInfo
+		if err := json.Unmarshal([]byte(data), &infos); err != nil {
+			warningLogger.Printf("Ignoring invalid %s annotation of %s/%s: %v", admissionWebhookAnnotationSidecarsKey, pod.Namespace, pod.Name, err)
+		}
+		for _, info := range infos {
+			names = append(names, info.Name)
+		}
+	}
+	if len(names) == 0 {
+		for _, c := range cfg.Containers {
+			names = append(names, c.Name)
+		}
+	}
+	if len(names) == 0 {
+		return false
+	}
+
+	for _, name := range names {
+		if hasContainer(pod.Spec.Containers, name) {
+			return false
+		}
+	}
+	return true
 }
 
-func addContainer(target, added []corev1.Container, basePath string) (patch []patchOperation) {
+// addContainer appends the operations adding the sidecar containers to patch
+func addContainer(patch []patchOperation, target, added []corev1.Container, basePath string, prepend bool) []patchOperation {
 	first := len(target) == 0
+	appendPath := basePath + "/-"
 	var value interface{}
-	for _, add := range added {
-		value = add
-		path := basePath
+	for i, add := range added {
+		value = &added[i]
+		path := appendPath
 		if first {
 			first = false
+			path = basePath
 			value = []corev1.Container{add}
+		} else if prepend && len(target) > 0 {
+			// keep the sidecars in configured order ahead of the pod containers
+			path = basePath + "/" + strconv.Itoa(i)
+		}
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  path,
+			Value: value,
+		})
+	}
+	return patch
+}
+
+// addVolume appends the operations adding the sidecar volumes to patch
+func addVolume(patch []patchOperation, target, added []corev1.Volume, basePath string) []patchOperation {
+	first := len(target) == 0
+	appendPath := basePath + "/-"
+	var value interface{}
+	for i, add := range added {
+		value = &added[i]
+		path := appendPath
+		if first {
+			first = false
+			path = basePath
+			value = []corev1.Volume{add}
+		}
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  path,
+			Value: value,
+		})
+	}
+	return patch
+}
+
+// addVolumeMounts appends the operations mounting the volumes into the container at index of
+// the patched pod to patch, mounts clashing by name or path with the container mounts are skipped
+func addVolumeMounts(patch []patchOperation, c *corev1.Container, index int, added []corev1.VolumeMount, basePath string) []patchOperation {
+	containerPath := basePath + "/" + strconv.Itoa(index)
+	// the path without the /- suffix creates the list
+	appendPath := containerPath + "/volumeMounts/-"
+	first := len(c.VolumeMounts) == 0
+	tested := false
+	var value interface{}
+	for i, mount := range added {
+		if hasVolumeMount(c.VolumeMounts, mount) {
+			continue
+		}
+		if !tested {
+			// make the API server reject the patch if the index no longer points at this container
+			tested = true
+			patch = append(patch, patchOperation{
+				Op:    "test",
+				Path:  containerPath + "/name",
+				Value: c.Name,
+			})
+		}
+		value = &added[i]
+		path := appendPath
+		if first {
+			first = false
+			path = appendPath[:len(appendPath)-len("/-")]
+			value = []corev1.VolumeMount{mount}
+		}
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  path,
+			Value: value,
+		})
+	}
+	return patch
+}
+
+func hasVolumeMount(mounts []corev1.VolumeMount, mount corev1.VolumeMount) bool {
+	for _, m := range mounts {
+		if m.Name == mount.Name || m.MountPath == mount.MountPath {
+			return true
+		}
+	}
+	return false
+}
+
+// addImagePullSecret appends the operations adding the pull secrets the pod doesn't reference yet to patch
+func addImagePullSecret(patch []patchOperation, target, added []corev1.LocalObjectReference, basePath string) []patchOperation {
+	first := len(target) == 0
+	var value interface{}
+	for i, add := range added {
+		if containsImagePullSecret(target, add.Name) {
+			continue
+		}
+		value = &added[i]
+		path := basePath
+		if first {
+			first = false
+			value = []corev1.LocalObjectReference{add}
 		} else {
 			path = path + "/-"
 		}
@@ -122,19 +1006,34 @@ func addContainer(target, added []corev1.Container, basePath string) (patch []pa
 			Path:  path,
 			Value: value,
 		})
+		target = append(target, add)
 	}
 	return patch
 }
 
-func addVolume(target, added []corev1.Volume, basePath string) (patch []patchOperation) {
+func containsImagePullSecret(secrets []corev1.LocalObjectReference, name string) bool {
+	for _, secret := range secrets {
+		if secret.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// addReadinessGate appends the operations adding the readiness gates the pod doesn't have yet to patch
+func addReadinessGate(patch []patchOperation, target []corev1.PodReadinessGate, added []string, basePath string) []patchOperation {
 	first := len(target) == 0
 	var value interface{}
-	for _, add := range added {
+	for _, conditionType := range added {
+		if hasReadinessGate(target, conditionType) {
+			continue
+		}
+		add := corev1.PodReadinessGate{ConditionType: corev1.PodConditionType(conditionType)}
 		value = add
 		path := basePath
 		if first {
 			first = false
-			value = []corev1.Volume{add}
+			value = []corev1.PodReadinessGate{add}
 		} else {
 			path = path + "/-"
 		}
@@ -143,46 +1042,234 @@ func addVolume(target, added []corev1.Volume, basePath string) (patch []patchOpe
 			Path:  path,
 			Value: value,
 		})
+		target = append(target, add)
 	}
 	return patch
 }
 
-func updateAnnotation(target map[string]string, added map[string]string) (patch []patchOperation) {
-	for key, value := range added {
-		if target == nil || target[key] == "" {
-			target = map[string]string{}
-			patch = append(patch, patchOperation{
-				Op:   "add",
-				Path: "/metadata/annotations",
-				Value: map[string]string{
-					key: value,
-				},
-			})
-		} else {
+func hasReadinessGate(gates []corev1.PodReadinessGate, conditionType string) bool {
+	for _, gate := range gates {
+		if string(gate.ConditionType) == conditionType {
+			return true
+		}
+	}
+	return false
+}
+
+// raiseTerminationGracePeriod appends the operation raising the grace period to min to patch, if it is lower
+func raiseTerminationGracePeriod(patch []patchOperation, target *int64, min *int64, path string) []patchOperation {
+	if min == nil {
+		return patch
+	}
+	// the API server defaults an unset grace period to 30 seconds
+	current := int64(corev1.DefaultTerminationGracePeriodSeconds)
+	if target != nil {
+		current = *target
+	}
+	if current >= *min {
+		return patch
+	}
+	return append(patch, patchOperation{
+		Op:    "add",
+		Path:  path,
+		Value: *min,
+	})
+}
+
+func updateAnnotation(patch []patchOperation, target map[string]string, added map[string]string) []patchOperation {
+	return updateMap(patch, target, added, "/metadata/annotations")
+}
+
+func updateLabel(patch []patchOperation, target map[string]string, added map[string]string) []patchOperation {
+	return updateMap(patch, target, added, "/metadata/labels")
+}
+
+// updateMap appends the operations merging the added entries into the target map at the given path
+// to patch, other entries are kept
+func updateMap(patch []patchOperation, target map[string]string, added map[string]string, basePath string) []patchOperation {
+	if len(target) == 0 {
+		// create the map at once, adding the entries one by one would overwrite each other
+		if len(added) > 0 {
 			patch = append(patch, patchOperation{
-				Op:    "replace",
-				Path:  "/metadata/annotations/" + key,
-				Value: value,
+				Op:    "add",
+				Path:  basePath,
+				Value: added,
 			})
 		}
+		return patch
+	}
+
+	for _, key := range sortedKeys(added) {
+		op := "add"
+		if _, ok := target[key]; ok {
+			op = "replace"
+		}
+		patch = append(patch, patchOperation{
+			Op:    op,
+			Path:  basePath + "/" + escapeJSONPointer(key),
+			Value: added[key],
+		})
 	}
 	return patch
 }
 
-// create mutation patch for resoures
-func createPatch(pod *corev1.Pod, sidecarConfig *Config, annotations map[string]string) ([]byte, error) {
-	var patch []patchOperation
+var jsonPointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
 
-	patch = append(patch, addContainer(pod.Spec.Containers, sidecarConfig.Containers, "/spec/containers")...)
-	patch = append(patch, addVolume(pod.Spec.Volumes, sidecarConfig.Volumes, "/spec/volumes")...)
-	patch = append(patch, updateAnnotation(pod.Annotations, annotations)...)
+// escapeJSONPointer escapes a map key to be used as a JSON pointer path segment (RFC 6901)
+func escapeJSONPointer(key string) string {
+	return jsonPointerEscaper.Replace(key)
+}
 
-	return json.Marshal(patch)
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// patchResult is the patch built by createPatch with a summary of what it injects
+type patchResult struct {
+	patch         []byte
+	operations    int
+	sidecars      []string // names of the injected sidecar containers
+	volumes       []string // names of the injected volumes
+	skippedMounts []string // <container>/<volume> mounts skipped as the container already mounts that name or path
+}
+
+// create mutation patch for resoures, on error the result only holds the operation count.
+// The operations are emitted in a fixed order, checkPatchOrder enforces the first two steps:
+//  1. sidecar containers, which shift the pod container indices when prepended
+//  2. volume mounts of the pod containers, at their shifted indices and guarded by test operations
+//  3. volumes, image pull secrets, readiness gates and the termination grace period
+//  4. annotations and labels
+//  5. the configured extra patches, which never touch the paths above
+func createPatch(pod *corev1.Pod, sidecarConfig *Config, annotations map[string]string) (*patchResult, error) {
+	labels := make(map[string]string, len(sidecarConfig.Labels)+1)
+	for key, value := range sidecarConfig.Labels {
+		labels[key] = value
+	}
+	if len(sidecarConfig.Containers) > 0 {
+		labels[sidecarCountLabelKey] = strconv.Itoa(len(sidecarConfig.Containers))
+	}
+	// size the patch for all operations up front, it is built for every admitted pod
+	patch := make([]patchOperation, 0, len(sidecarConfig.Containers)+
+		len(pod.Spec.Containers)*(len(sidecarConfig.appVolumeMounts)+1)+
+		len(sidecarConfig.Volumes)+len(sidecarConfig.ImagePullSecrets)+len(sidecarConfig.ReadinessGates)+1+
+		len(annotations)+len(labels)+len(sidecarConfig.ExtraPatches))
+	result := &patchResult{
+		sidecars: make([]string, 0, len(sidecarConfig.Containers)),
+		volumes:  make([]string, 0, len(sidecarConfig.Volumes)),
+	}
+
+	prepend := sidecarConfig.ContainerPosition == containerPositionPrepend
+	patch = addContainer(patch, pod.Spec.Containers, sidecarConfig.Containers, "/spec/containers", prepend)
+	for _, c := range sidecarConfig.Containers {
+		result.sidecars = append(result.sidecars, c.Name)
+	}
+	// the pod containers are shifted behind the sidecars when those are prepended
+	offset := 0
+	if prepend && len(pod.Spec.Containers) > 0 {
+		offset = len(sidecarConfig.Containers)
+	}
+	for i := range pod.Spec.Containers {
+		c := &pod.Spec.Containers[i]
+		if sidecarConfig.excludedContainers[c.Name] {
+			continue
+		}
+		patch = addVolumeMounts(patch, c, offset+i, sidecarConfig.appVolumeMounts, "/spec/containers")
+		for _, m := range sidecarConfig.appVolumeMounts {
+			if hasVolumeMount(c.VolumeMounts, m) {
+				result.skippedMounts = append(result.skippedMounts, c.Name+"/"+m.Name)
+			}
+		}
+	}
+	patch = addVolume(patch, pod.Spec.Volumes, sidecarConfig.Volumes, "/spec/volumes")
+	for _, v := range sidecarConfig.Volumes {
+		result.volumes = append(result.volumes, v.Name)
+	}
+	patch = addImagePullSecret(patch, pod.Spec.ImagePullSecrets, sidecarConfig.ImagePullSecrets, "/spec/imagePullSecrets")
+	patch = addReadinessGate(patch, pod.Spec.ReadinessGates, sidecarConfig.ReadinessGates, "/spec/readinessGates")
+	patch = raiseTerminationGracePeriod(patch, pod.Spec.TerminationGracePeriodSeconds, sidecarConfig.MinTerminationGracePeriodSeconds, "/spec/terminationGracePeriodSeconds")
+	patch = updateAnnotation(patch, pod.Annotations, annotations)
+	patch = updateLabel(patch, pod.Labels, labels)
+	patch = append(patch, sidecarConfig.ExtraPatches...)
+	result.operations = len(patch)
+	if err := checkPatchOrder(patch); err != nil {
+		return result, err
+	}
+
+	patchBytes, err := json.Marshal(patch)
+	if err != nil {
+		return result, err
+	}
+	result.patch = patchBytes
+
+	return result, nil
+}
+
+// checkPatchOrder checks no operation adds a container after an operation into a container,
+// the container indices used by the latter would no longer point at the intended containers
+func checkPatchOrder(patch []patchOperation) error {
+	intoContainer := ""
+	for _, op := range patch {
+		if op.Path != "/spec/containers" && !strings.HasPrefix(op.Path, "/spec/containers/") {
+			continue
+		}
+		if strings.Count(op.Path, "/") > 3 {
+			if intoContainer == "" {
+				intoContainer = op.Path
+			}
+		} else if intoContainer != "" {
+			return fmt.Errorf("patch operation %s %s follows operation on %s and shifts its container index", op.Op, op.Path, intoContainer)
+		}
+	}
+	return nil
 }
 
 // main mutation process
 func (whsvr *WebhookServer) mutate(ar *admissionv1.AdmissionReview) *admissionv1.AdmissionResponse {
 	req := ar.Request
+	if req == nil {
+		warningLogger.Println("AdmissionReview has no request")
+		return &admissionv1.AdmissionResponse{
+			Allowed: false,
+			Result: &metav1.Status{
+				Code:    http.StatusBadRequest,
+				Reason:  metav1.StatusReasonBadRequest,
+				Message: "AdmissionReview has no request",
+			},
+		}
+	}
+	// the webhook only knows how to mutate pods, admit anything else unchanged
+	if req.Kind.Group != "" || req.Kind.Kind != "Pod" {
+		warningLogger.Printf("Skipping mutation for unexpected kind %v of %s/%s, check the webhook rules", req.Kind, req.Namespace, req.Name)
+		return &admissionv1.AdmissionResponse{
+			Allowed:  true,
+			Warnings: []string{fmt.Sprintf("sidecar injector only mutates pods, %s/%s was admitted unchanged", req.Kind.Kind, req.Name)},
+		}
+	}
+
+	// DELETE requests only carry the old object, there is nothing to inject into
+	if len(req.Object.Raw) == 0 {
+		if len(req.OldObject.Raw) > 0 {
+			infoLogger.Printf("Skipping mutation for %s/%s on %s operation without object", req.Namespace, req.Name, req.Operation)
+			return &admissionv1.AdmissionResponse{
+				Allowed: true,
+			}
+		}
+		warningLogger.Printf("AdmissionReview for %s/%s has no object", req.Namespace, req.Name)
+		return &admissionv1.AdmissionResponse{
+			Allowed: false,
+			Result: &metav1.Status{
+				Code:    http.StatusBadRequest,
+				Reason:  metav1.StatusReasonBadRequest,
+				Message: fmt.Sprintf("%s request for %s/%s has no object", req.Operation, req.Namespace, req.Name),
+			},
+		}
+	}
+
 	var pod corev1.Pod
 	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
 		warningLogger.Printf("Could not unmarshal raw object: %v", err)
@@ -196,16 +1283,141 @@ func (whsvr *WebhookServer) mutate(ar *admissionv1.AdmissionReview) *admissionv1
 	infoLogger.Printf("AdmissionReview for Kind=%v, Namespace=%v Name=%v (%v) UID=%v patchOperation=%v UserInfo=%v",
 		req.Kind, req.Namespace, req.Name, pod.Name, req.UID, req.Operation, req.UserInfo)
 
+	admissionRequestsTotal.WithLabelValues(string(req.Operation)).Inc()
+	if req.SubResource == ephemeralContainersSubResource {
+		if !ephemeralContainers {
+			return &admissionv1.AdmissionResponse{
+				Allowed: true,
+			}
+		}
+		return whsvr.mutateEphemeralContainers(req, &pod)
+	}
+
+	// only inject on creation unless asked to, re-mutating on update leads to spurious patches
+	if req.Operation != admissionv1.Create && !(injectOnUpdate && req.Operation == admissionv1.Update) {
+		infoLogger.Printf("Skipping mutation for %s/%s on %s operation", pod.Namespace, pod.Name, req.Operation)
+		return &admissionv1.AdmissionResponse{
+			Allowed: true,
+		}
+	}
+
+	// warnings are returned to the client, e.g. shown by kubectl apply
+	var warnings []string
+
+	sidecarConfig := whsvr.config()
+	// containers can't be added to an existing pod, so a stale status is only acted on at creation
+	if req.Operation == admissionv1.Create && staleInjectionStatus(&pod, sidecarConfig) {
+		infoLogger.Printf("Pod %s/%s is annotated as injected but has none of the sidecars, injecting again", pod.Namespace, pod.Name)
+		delete(pod.Annotations, admissionWebhookAnnotationStatusKey)
+	}
+
 	// determine whether to perform mutation
-	if !mutationRequired(ignoredNamespaces, &pod.ObjectMeta) {
+	required, warning := mutationRequired(ignoredNamespaces, &pod.ObjectMeta)
+	if warning != "" {
+		warnings = append(warnings, warning)
+	}
+	if !required {
 		infoLogger.Printf("Skipping mutation for %s/%s due to policy check", pod.Namespace, pod.Name)
 		return &admissionv1.AdmissionResponse{
-			Allowed: true,
+			Allowed:  true,
+			Warnings: warnings,
+		}
+	}
+
+	if missing := whsvr.csiDrivers.missingDrivers(); len(missing) > 0 {
+		warningLogger.Printf("Skipping mutation for %s/%s: CSI drivers %v used by the sidecar volumes are not installed", pod.Namespace, pod.Name, missing)
+		return &admissionv1.AdmissionResponse{
+			Allowed:  true,
+			Warnings: append(warnings, fmt.Sprintf("sidecars not injected: CSI drivers %v are not installed", missing)),
 		}
 	}
 
 	annotations := map[string]string{admissionWebhookAnnotationStatusKey: "injected"}
-	patchBytes, err := createPatch(&pod, whsvr.sidecarConfig, annotations)
+	if instanceName != "" {
+		annotations[admissionWebhookAnnotationInjectedByKey] = instanceName
+	}
+	image, err := sidecarImageOverride(&pod.ObjectMeta)
+	if err != nil {
+		warningLogger.Printf("Ignoring sidecar image override for %s/%s: %v", pod.Namespace, pod.Name, err)
+		warnings = append(warnings, fmt.Sprintf("ignoring %s annotation: %v", admissionWebhookAnnotationImageKey, err))
+	} else if image != "" {
+		infoLogger.Printf("Overriding sidecar image for %s/%s with %s", pod.Namespace, pod.Name, image)
+		sidecarConfig = sidecarConfig.withSidecarImage(image)
+		annotations[admissionWebhookAnnotationEffectiveImageKey] = image
+	}
+	if value, ok := pod.Annotations[admissionWebhookAnnotationReadOnlyAllKey]; ok {
+		if readOnly, ok := parseAnnotationBool(value); !ok {
+			warnings = append(warnings, fmt.Sprintf("ignoring %s annotation, unrecognized value %q, expect true or false", admissionWebhookAnnotationReadOnlyAllKey, value))
+		} else if readOnly {
+			infoLogger.Printf("Mounting the injected volumes read-only into the containers of %s/%s", pod.Namespace, pod.Name)
+			sidecarConfig = sidecarConfig.withReadOnlyMounts()
+		}
+	}
+	if value, ok := pod.Annotations[admissionWebhookAnnotationExcludeKey]; ok {
+		var excluded []string
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+			if !hasContainer(pod.Spec.Containers, name) {
+				warnings = append(warnings, fmt.Sprintf("%s annotation names unknown container %q", admissionWebhookAnnotationExcludeKey, name))
+				continue
+			}
+			excluded = append(excluded, name)
+		}
+		infoLogger.Printf("Not mounting the injected volumes into containers %v of %s/%s", excluded, pod.Namespace, pod.Name)
+		sidecarConfig = sidecarConfig.withExcludedContainers(excluded)
+	}
+	// renaming on a name clash below only adds a few bytes to the sidecars annotation
+	withSidecarInfo := sidecarInfoVolume
+	if withSidecarInfo {
+		if info, err := sidecarConfig.sidecarsAnnotation(); err != nil || len(info) > sidecarInfoMaxBytes {
+			warningLogger.Printf("Not mounting the sidecar info file into %s/%s: sidecars annotation is too large (%d bytes) or invalid: %v", pod.Namespace, pod.Name, len(info), err)
+			warnings = append(warnings, "sidecar info file not mounted, the sidecar list is too large for an annotation")
+			withSidecarInfo = false
+		}
+	}
+	if withSidecarInfo {
+		sidecarConfig = sidecarConfig.withSidecarInfoVolume()
+	}
+	configured := sidecarConfig
+	sidecarConfig, renamed, err := sidecarConfig.resolveNameConflicts(&pod)
+	if err != nil {
+		warningLogger.Printf("Skipping mutation for %s/%s: %v", pod.Namespace, pod.Name, err)
+		return &admissionv1.AdmissionResponse{
+			Allowed:  true,
+			Warnings: append(warnings, fmt.Sprintf("sidecars not injected: %v", err)),
+		}
+	}
+	for _, r := range renamed {
+		infoLogger.Printf("Renamed sidecar %s for %s/%s to avoid a name clash", r, pod.Namespace, pod.Name)
+		warnings = append(warnings, fmt.Sprintf("renamed injected %s, the pod already uses that name", r))
+	}
+	if ephemeralContainers {
+		// record the names the volumes were injected with for the ephemeral containers
+		volumes, err := volumesAnnotation(configured.Volumes, sidecarConfig.Volumes)
+		if err != nil {
+			return &admissionv1.AdmissionResponse{
+				Result: &metav1.Status{
+					Message: err.Error(),
+				},
+			}
+		}
+		annotations[admissionWebhookAnnotationVolumesKey] = volumes
+	}
+	if withSidecarInfo {
+		info, err := sidecarConfig.sidecarsAnnotation()
+		if err != nil {
+			return &admissionv1.AdmissionResponse{
+				Result: &metav1.Status{
+					Message: err.Error(),
+				},
+			}
+		}
+		annotations[admissionWebhookAnnotationSidecarsKey] = info
+	}
+	result, err := createPatch(&pod, sidecarConfig, annotations)
+	observePatch(result, err)
 	if err != nil {
 		return &admissionv1.AdmissionResponse{
 			Result: &metav1.Status{
@@ -213,11 +1425,30 @@ func (whsvr *WebhookServer) mutate(ar *admissionv1.AdmissionReview) *admissionv1
 			},
 		}
 	}
+	patchBytes := result.patch
+	countInjection(req.Namespace, result.sidecars)
+	infoLogger.Printf("Injecting sidecars %v and volumes %v into %s/%s", result.sidecars, result.volumes, pod.Namespace, pod.Name)
+	for _, m := range result.skippedMounts {
+		warnings = append(warnings, fmt.Sprintf("volume mount %s not injected, the container already mounts that volume name or path", m))
+	}
+	if patchSizeWarningBytes > 0 && len(patchBytes) > patchSizeWarningBytes {
+		warningLogger.Printf("Patch for %s/%s is %d bytes with %d operations, over the %d bytes warning threshold, consider injecting fewer sidecars or volumes",
+			pod.Namespace, pod.Name, len(patchBytes), result.operations, patchSizeWarningBytes)
+	}
 
-	infoLogger.Printf("AdmissionResponse: patch=%v\n", string(patchBytes))
+	if debug {
+		var pretty bytes.Buffer
+		if redacted, err := redactPatchEnv(patchBytes); err == nil && json.Indent(&pretty, redacted, "", "  ") == nil {
+			debugLogger.Printf("AdmissionResponse for %s/%s: size=%d patch=\n%s", pod.Namespace, pod.Name, len(patchBytes), pretty.String())
+		}
+		logMutatedPod(&pod, patchBytes)
+	} else {
+		infoLogger.Printf("AdmissionResponse: size=%d patch=%v\n", len(patchBytes), string(patchBytes))
+	}
 	return &admissionv1.AdmissionResponse{
-		Allowed: true,
-		Patch:   patchBytes,
+		Allowed:  true,
+		Warnings: warnings,
+		Patch:    patchBytes,
 		PatchType: func() *admissionv1.PatchType {
 			pt := admissionv1.PatchTypeJSONPatch
 			return &pt
@@ -225,13 +1456,92 @@ func (whsvr *WebhookServer) mutate(ar *admissionv1.AdmissionReview) *admissionv1
 	}
 }
 
+// logMutatedPod logs the spec of the pod as patched, with literal env values redacted, and the
+// containers and volumes the patch adds, it is only called with -debug as the spec can be large
+func logMutatedPod(pod *corev1.Pod, patchBytes []byte) {
+	mutated, err := applyPatch(pod, patchBytes)
+	if err != nil {
+		debugLogger.Printf("Could not apply the patch to %s/%s: %v", pod.Namespace, pod.Name, err)
+		return
+	}
+
+	var diff []string
+	for _, c := range mutated.Spec.Containers {
+		if !hasContainer(pod.Spec.Containers, c.Name) {
+			diff = append(diff, "+container "+c.Name)
+		}
+	}
+	for _, v := range mutated.Spec.Volumes {
+		if !hasVolume(pod.Spec.Volumes, v.Name) {
+			diff = append(diff, "+volume "+v.Name)
+		}
+	}
+
+	redactEnv(mutated.Spec.InitContainers)
+	redactEnv(mutated.Spec.Containers)
+	spec, err := json.Marshal(mutated.Spec)
+	if err != nil {
+		debugLogger.Printf("Could not encode the mutated pod %s/%s: %v", pod.Namespace, pod.Name, err)
+		return
+	}
+	debugLogger.Printf("Mutated pod %s/%s: diff=%q spec=%s", pod.Namespace, pod.Name, diff, spec)
+}
+
+// serveReadyz reports not ready while a CSI driver is missing or the self-test failed,
+// ?deep=true runs the self-test again before answering, at most once per selfTestMinInterval
+func (whsvr *WebhookServer) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	if missing := whsvr.csiDrivers.missingDrivers(); len(missing) > 0 {
+		http.Error(w, fmt.Sprintf("csi drivers not installed: %v", missing), http.StatusServiceUnavailable)
+		return
+	}
+	err := whsvr.selfTest.lastError()
+	if r.URL.Query().Get("deep") == "true" && whsvr.selfTest != nil {
+		err = whsvr.selfTest.runCached(r.Context(), whsvr.config(), selfTestMinInterval)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// serveConfig returns the loaded configuration with its sha256, redacted, to clients presenting
+// the -config-endpoint-token-file bearer token
+func (whsvr *WebhookServer) serveConfig(w http.ResponseWriter, r *http.Request) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") ||
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(configEndpointToken)) != 1 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	cfg := whsvr.config()
+	resp, err := json.Marshal(struct {
+		Sha256 string  `json:"sha256"`
+		Config *Config `json:"config"`
+	}{cfg.checksum, cfg.redacted()})
+	if err != nil {
+		errorLogger.Printf("Can't encode configuration: %v", err)
+		http.Error(w, fmt.Sprintf("could not encode configuration: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(resp); err != nil {
+		errorLogger.Printf("Can't write response: %v", err)
+	}
+}
+
 // Serve method for webhook server
 func (whsvr *WebhookServer) serve(w http.ResponseWriter, r *http.Request) {
 	var body []byte
 	if r.Body != nil {
-		if data, err := ioutil.ReadAll(r.Body); err == nil {
-			body = data
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			warningLogger.Printf("Can't read body: %v", err)
+			http.Error(w, fmt.Sprintf("could not read body: %v", err), http.StatusBadRequest)
+			return
 		}
+		body = data
 	}
 	if len(body) == 0 {
 		warningLogger.Println("empty body")
@@ -240,8 +1550,9 @@ func (whsvr *WebhookServer) serve(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// verify the content type is accurate
+	// parameters such as charset=utf-8 are accepted
 	contentType := r.Header.Get("Content-Type")
-	if contentType != "application/json" {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || mediaType != "application/json" {
 		warningLogger.Printf("Content-Type=%s, expect application/json", contentType)
 		http.Error(w, "invalid Content-Type, expect `application/json`", http.StatusUnsupportedMediaType)
 		return
@@ -277,6 +1588,7 @@ func (whsvr *WebhookServer) serve(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		warningLogger.Printf("Can't encode response: %v", err)
 		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+		return
 	}
 	infoLogger.Printf("Ready to write reponse ...")
 	if _, err := w.Write(resp); err != nil {
@@ -0,0 +1,2727 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+var update = flag.Bool("update", false, "Update the golden files in testdata.")
+
+// checkGolden compares got with the golden file in testdata, or writes it with -update
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	file := filepath.Join("testdata", name)
+	if *update {
+		if err := ioutil.WriteFile(file, got, 0644); err != nil {
+			t.Fatalf("Failed to update %s: %v", file, err)
+		}
+		return
+	}
+	want, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Failed to read %s, run the test with -update to create it: %v", file, err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs from the golden file, run the test with -update after checking the change\ngot:\n%s\nwant:\n%s", file, got, want)
+	}
+}
+
+// setNameConflictPolicy sets -name-conflict-policy for the test
+func setNameConflictPolicy(t testing.TB, policy string) {
+	old := nameConflictPolicy
+	nameConflictPolicy = policy
+	t.Cleanup(func() { nameConflictPolicy = old })
+}
+
+// setAllowedImageRegistries sets -allowed-image-registries for the test
+func setAllowedImageRegistries(t testing.TB, registries ...string) {
+	old := allowedImageRegistries
+	allowedImageRegistries = registries
+	t.Cleanup(func() { allowedImageRegistries = old })
+}
+
+// setSidecarInfoPath sets -sidecar-info-path for the test
+func setSidecarInfoPath(t testing.TB, path string) {
+	old := sidecarInfoPath
+	sidecarInfoPath = path
+	t.Cleanup(func() { sidecarInfoPath = old })
+}
+
+// setBoolFlag sets a boolean flag variable for the test
+func setBoolFlag(t testing.TB, flag *bool, value bool) {
+	old := *flag
+	*flag = value
+	t.Cleanup(func() { *flag = old })
+}
+
+// captureLogger redirects the logger to a buffer for the test
+func captureLogger(t testing.TB, logger **log.Logger) *bytes.Buffer {
+	old := *logger
+	var buf bytes.Buffer
+	*logger = log.New(&buf, old.Prefix(), 0)
+	t.Cleanup(func() { *logger = old })
+	return &buf
+}
+
+func testConflictConfig() *Config {
+	return &Config{
+		Containers: []corev1.Container{
+			{Name: "sidecar", VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: "/data"}}},
+			{Name: "sidecar-2"},
+		},
+		Volumes:         []corev1.Volume{{Name: "data"}, {Name: "data-2"}},
+		appVolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: "/data"}},
+	}
+}
+
+func containerNames(containers []corev1.Container) []string {
+	var names []string
+	for _, c := range containers {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+func volumeNames(volumes []corev1.Volume) []string {
+	var names []string
+	for _, v := range volumes {
+		names = append(names, v.Name)
+	}
+	return names
+}
+
+func TestResolveNameConflicts(t *testing.T) {
+	tests := []struct {
+		name           string
+		pod            corev1.PodSpec
+		wantContainers []string
+		wantVolumes    []string
+		wantMountName  string
+		wantRenamed    int
+	}{
+		{
+			name:           "no clash",
+			pod:            corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}, Volumes: []corev1.Volume{{Name: "app-data"}}},
+			wantContainers: []string{"sidecar", "sidecar-2"},
+			wantVolumes:    []string{"data", "data-2"},
+			wantMountName:  "data",
+		},
+		{
+			// sidecar-2 is taken by the other sidecar, so the clash goes to the next free suffix
+			name:           "container clash",
+			pod:            corev1.PodSpec{Containers: []corev1.Container{{Name: "sidecar"}}},
+			wantContainers: []string{"sidecar-3", "sidecar-2"},
+			wantVolumes:    []string{"data", "data-2"},
+			wantMountName:  "data",
+			wantRenamed:    1,
+		},
+		{
+			name:           "init container clash",
+			pod:            corev1.PodSpec{InitContainers: []corev1.Container{{Name: "sidecar-2"}}, Containers: []corev1.Container{{Name: "app"}}},
+			wantContainers: []string{"sidecar", "sidecar-2-2"},
+			wantVolumes:    []string{"data", "data-2"},
+			wantMountName:  "data",
+			wantRenamed:    1,
+		},
+		{
+			name:           "volume clash renames the mounts",
+			pod:            corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}, Volumes: []corev1.Volume{{Name: "data"}, {Name: "data-3"}}},
+			wantContainers: []string{"sidecar", "sidecar-2"},
+			wantVolumes:    []string{"data-4", "data-2"},
+			wantMountName:  "data-4",
+			wantRenamed:    1,
+		},
+		{
+			name: "all clash",
+			pod: corev1.PodSpec{
+				InitContainers: []corev1.Container{{Name: "sidecar"}},
+				Containers:     []corev1.Container{{Name: "sidecar-2"}},
+				Volumes:        []corev1.Volume{{Name: "data"}, {Name: "data-2"}},
+			},
+			wantContainers: []string{"sidecar-3", "sidecar-2-2"},
+			wantVolumes:    []string{"data-3", "data-2-2"},
+			wantMountName:  "data-3",
+			wantRenamed:    4,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setNameConflictPolicy(t, nameConflictPolicyRename)
+			cfg := testConflictConfig()
+			got, renamed, err := cfg.resolveNameConflicts(&corev1.Pod{Spec: tt.pod})
+			if err != nil {
+				t.Fatalf("resolveNameConflicts returned error: %v", err)
+			}
+			if names := containerNames(got.Containers); !reflect.DeepEqual(names, tt.wantContainers) {
+				t.Errorf("containers = %v, want %v", names, tt.wantContainers)
+			}
+			if names := volumeNames(got.Volumes); !reflect.DeepEqual(names, tt.wantVolumes) {
+				t.Errorf("volumes = %v, want %v", names, tt.wantVolumes)
+			}
+			if name := got.Containers[0].VolumeMounts[0].Name; name != tt.wantMountName {
+				t.Errorf("sidecar volume mount = %q, want %q", name, tt.wantMountName)
+			}
+			if name := got.appVolumeMounts[0].Name; name != tt.wantMountName {
+				t.Errorf("app volume mount = %q, want %q", name, tt.wantMountName)
+			}
+			if len(renamed) != tt.wantRenamed {
+				t.Errorf("renamed = %v, want %d entries", renamed, tt.wantRenamed)
+			}
+
+			// the loaded config is shared between requests and must not change
+			if !reflect.DeepEqual(cfg, testConflictConfig()) {
+				t.Errorf("resolveNameConflicts modified the config: %+v", cfg)
+			}
+		})
+	}
+}
+
+func TestResolveNameConflictsSkipPolicy(t *testing.T) {
+	setNameConflictPolicy(t, nameConflictPolicySkip)
+	cfg := testConflictConfig()
+
+	pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}}}
+	got, _, err := cfg.resolveNameConflicts(pod)
+	if err != nil || got != cfg {
+		t.Errorf("resolveNameConflicts without clash = %p, %v, want the config unchanged", got, err)
+	}
+
+	pod = &corev1.Pod{Spec: corev1.PodSpec{
+		InitContainers: []corev1.Container{{Name: "sidecar"}},
+		Volumes:        []corev1.Volume{{Name: "data-2"}},
+	}}
+	_, _, err = cfg.resolveNameConflicts(pod)
+	if err == nil {
+		t.Fatal("resolveNameConflicts with clashes returned no error")
+	}
+	for _, clash := range []string{"container sidecar", "volume data-2"} {
+		if !strings.Contains(err.Error(), clash) {
+			t.Errorf("error %q does not name %s", err, clash)
+		}
+	}
+}
+
+func TestUniqueName(t *testing.T) {
+	long := strings.Repeat("a", 63)
+	tests := []struct {
+		name string
+		used []string
+		want string
+	}{
+		{name: "sidecar", want: "sidecar-2"},
+		{name: "sidecar", used: []string{"sidecar-2", "sidecar-3"}, want: "sidecar-4"},
+		{name: long, want: strings.Repeat("a", 61) + "-2"},
+		{name: strings.Repeat("a", 61), want: strings.Repeat("a", 61) + "-2"},
+		{name: strings.Repeat("a", 62), want: strings.Repeat("a", 61) + "-2"},
+		{name: long, used: []string{strings.Repeat("a", 61) + "-2"}, want: strings.Repeat("a", 61) + "-3"},
+		// truncation must not leave a dash before the suffix
+		{name: strings.Repeat("a", 60) + "-bc", want: strings.Repeat("a", 60) + "-2"},
+	}
+	for _, tt := range tests {
+		used := map[string]bool{}
+		for _, name := range tt.used {
+			used[name] = true
+		}
+		got := uniqueName(tt.name, used)
+		if got != tt.want {
+			t.Errorf("uniqueName(%q, %v) = %q, want %q", tt.name, tt.used, got, tt.want)
+		}
+		if len(got) > 63 {
+			t.Errorf("uniqueName(%q) = %q is longer than 63 characters", tt.name, got)
+		}
+		if !used[got] {
+			t.Errorf("uniqueName(%q) did not mark %q used", tt.name, got)
+		}
+	}
+}
+
+func TestMutationRequired(t *testing.T) {
+	tests := []struct {
+		name            string
+		namespace       string
+		annotations     map[string]string
+		injectByDefault bool
+		want            bool
+		wantWarning     bool
+	}{
+		{name: "no annotations", want: true},
+		{name: "empty", annotations: map[string]string{admissionWebhookAnnotationInjectKey: ""}, want: true},
+		{name: "yes", annotations: map[string]string{admissionWebhookAnnotationInjectKey: "yes"}, want: true},
+		{name: "trailing space", annotations: map[string]string{admissionWebhookAnnotationInjectKey: "yes "}, want: true},
+		{name: "mixed case", annotations: map[string]string{admissionWebhookAnnotationInjectKey: "True"}, want: true},
+		{name: "y", annotations: map[string]string{admissionWebhookAnnotationInjectKey: "y"}, want: true},
+		{name: "on", annotations: map[string]string{admissionWebhookAnnotationInjectKey: " ON"}, want: true},
+		{name: "no", annotations: map[string]string{admissionWebhookAnnotationInjectKey: "no"}, want: false},
+		{name: "n", annotations: map[string]string{admissionWebhookAnnotationInjectKey: "n"}, want: false},
+		{name: "not", annotations: map[string]string{admissionWebhookAnnotationInjectKey: "not"}, want: false},
+		{name: "false with whitespace", annotations: map[string]string{admissionWebhookAnnotationInjectKey: "\tfalse\n"}, want: false},
+		{name: "off mixed case", annotations: map[string]string{admissionWebhookAnnotationInjectKey: "Off"}, want: false},
+		{
+			name:            "typo injects by default",
+			annotations:     map[string]string{admissionWebhookAnnotationInjectKey: "flase"},
+			injectByDefault: true,
+			want:            true,
+			wantWarning:     true,
+		},
+		{
+			name:        "typo without inject by default",
+			annotations: map[string]string{admissionWebhookAnnotationInjectKey: "flase"},
+			want:        false,
+			wantWarning: true,
+		},
+		{
+			name:        "already injected",
+			annotations: map[string]string{admissionWebhookAnnotationStatusKey: "injected", admissionWebhookAnnotationInjectKey: "yes"},
+			want:        false,
+		},
+		{
+			name:            "already injected skips the inject value",
+			annotations:     map[string]string{admissionWebhookAnnotationStatusKey: "Injected", admissionWebhookAnnotationInjectKey: "flase"},
+			injectByDefault: true,
+			want:            false,
+		},
+		{name: "ignored namespace", namespace: metav1.NamespaceSystem, annotations: map[string]string{admissionWebhookAnnotationInjectKey: "yes"}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := injectByDefault
+			injectByDefault = tt.injectByDefault
+			defer func() { injectByDefault = old }()
+
+			namespace := tt.namespace
+			if namespace == "" {
+				namespace = "default"
+			}
+			metadata := &metav1.ObjectMeta{Name: "pod", Namespace: namespace, Annotations: tt.annotations}
+			got, warning := mutationRequired(ignoredNamespaces, metadata)
+			if got != tt.want {
+				t.Errorf("mutationRequired = %v, want %v", got, tt.want)
+			}
+			if (warning != "") != tt.wantWarning {
+				t.Errorf("mutationRequired warning = %q, want warning %v", warning, tt.wantWarning)
+			}
+			if tt.wantWarning && !strings.Contains(warning, "flase") {
+				t.Errorf("warning %q does not name the unrecognized value", warning)
+			}
+		})
+	}
+}
+
+func newTestWebhookServer(cfg *Config) *WebhookServer {
+	whsvr := &WebhookServer{}
+	whsvr.setConfig(cfg)
+	return whsvr
+}
+
+// serveReview posts the body to serve and decodes the AdmissionReview it answers with
+func serveReview(t *testing.T, whsvr *WebhookServer, body, contentType string) (*httptest.ResponseRecorder, *admissionv1.AdmissionReview) {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodPost, webhookInjectPath, strings.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	whsvr.serve(w, r)
+	if w.Code != http.StatusOK {
+		return w, nil
+	}
+	var review admissionv1.AdmissionReview
+	if err := json.Unmarshal(w.Body.Bytes(), &review); err != nil {
+		t.Fatalf("serve returned an invalid AdmissionReview %q: %v", w.Body.String(), err)
+	}
+	if review.Kind != "AdmissionReview" || review.APIVersion != "admission.k8s.io/v1" || review.Response == nil {
+		t.Fatalf("serve returned an incomplete AdmissionReview %q", w.Body.String())
+	}
+	return w, &review
+}
+
+// mutatePod sends the pod through mutate in an admission request for the operation
+func mutatePod(t *testing.T, whsvr *WebhookServer, pod *corev1.Pod, op admissionv1.Operation) *admissionv1.AdmissionResponse {
+	t.Helper()
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := whsvr.mutate(&admissionv1.AdmissionReview{Request: &admissionv1.AdmissionRequest{
+		UID:       "uid",
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Namespace: pod.Namespace,
+		Name:      pod.Name,
+		Operation: op,
+		Object:    runtime.RawExtension{Raw: raw},
+	}})
+	if !resp.Allowed {
+		t.Fatalf("mutate denied %s/%s: %+v", pod.Namespace, pod.Name, resp.Result)
+	}
+	return resp
+}
+
+// patchedPod applies the patch of the response to a copy of the pod
+func patchedPod(t *testing.T, pod *corev1.Pod, resp *admissionv1.AdmissionResponse) *corev1.Pod {
+	t.Helper()
+	if len(resp.Patch) == 0 {
+		return pod.DeepCopy()
+	}
+	mutated, err := applyPatch(pod, resp.Patch)
+	if err != nil {
+		t.Fatalf("patch %s does not apply: %v", resp.Patch, err)
+	}
+	return mutated
+}
+
+func TestServeMalformedRequests(t *testing.T) {
+	whsvr := newTestWebhookServer(testConflictConfig())
+	tests := []struct {
+		name        string
+		body        string
+		wantAllowed bool
+		wantCode    int32
+		wantUID     string
+	}{
+		{
+			name:     "null request",
+			body:     `{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","request":null}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "missing request",
+			body:     `{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview"}`,
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name: "delete with old object only",
+			body: `{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","request":{"uid":"uid-delete",` +
+				`"kind":{"version":"v1","kind":"Pod"},"operation":"DELETE","namespace":"default","name":"app",` +
+				`"oldObject":{"apiVersion":"v1","kind":"Pod","metadata":{"name":"app"}}}}`,
+			wantAllowed: true,
+			wantUID:     "uid-delete",
+		},
+		{
+			name: "empty object",
+			body: `{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","request":{"uid":"uid-empty",` +
+				`"kind":{"version":"v1","kind":"Pod"},"operation":"CREATE","namespace":"default","name":"app"}}`,
+			wantCode: http.StatusBadRequest,
+			wantUID:  "uid-empty",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, review := serveReview(t, whsvr, tt.body, "application/json")
+			if review == nil {
+				t.Fatalf("serve returned HTTP %d %q, want an AdmissionReview", w.Code, w.Body.String())
+			}
+			resp := review.Response
+			if resp.Allowed != tt.wantAllowed {
+				t.Errorf("allowed = %v, want %v", resp.Allowed, tt.wantAllowed)
+			}
+			if string(resp.UID) != tt.wantUID {
+				t.Errorf("uid = %q, want %q", resp.UID, tt.wantUID)
+			}
+			if len(resp.Patch) != 0 {
+				t.Errorf("unexpected patch %s", resp.Patch)
+			}
+			if tt.wantCode == 0 {
+				if resp.Result != nil {
+					t.Errorf("unexpected status %+v", resp.Result)
+				}
+				return
+			}
+			if resp.Result == nil || resp.Result.Code != tt.wantCode || resp.Result.Reason != metav1.StatusReasonBadRequest || resp.Result.Message == "" {
+				t.Errorf("status = %+v, want code %d reason %s with a message", resp.Result, tt.wantCode, metav1.StatusReasonBadRequest)
+			}
+		})
+	}
+}
+
+// admissionReviewSeeds are AdmissionReview bodies as sent by the API server, plus malformed ones
+var admissionReviewSeeds = []string{
+	`{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","request":{"uid":"705ab4f5-6393-11e8-b7cc-42010a800002",` +
+		`"kind":{"group":"","version":"v1","kind":"Pod"},"resource":{"group":"","version":"v1","resource":"pods"},` +
+		`"requestKind":{"group":"","version":"v1","kind":"Pod"},"requestResource":{"group":"","version":"v1","resource":"pods"},` +
+		`"namespace":"test-ns","operation":"CREATE","userInfo":{"username":"system:serviceaccount:kube-system:replicaset-controller"},` +
+		`"object":{"apiVersion":"v1","kind":"Pod","metadata":{"generateName":"alpine-","namespace":"test-ns",` +
+		`"annotations":{"sidecar-injector-webhook.morven.me/inject":"yes"}},"spec":{"containers":[{"name":"alpine","image":"alpine",` +
+		`"volumeMounts":[{"name":"data","mountPath":"/data"}]}],"volumes":[{"name":"data","emptyDir":{}}]}},` +
+		`"oldObject":null,"dryRun":false,"options":{"apiVersion":"meta.k8s.io/v1","kind":"CreateOptions"}}}`,
+	`{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","request":null}`,
+	`{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","request":{"uid":"1","kind":{"version":"v1","kind":"Pod"},` +
+		`"operation":"DELETE","namespace":"test-ns","name":"alpine","oldObject":{"apiVersion":"v1","kind":"Pod","metadata":{"name":"alpine"}}}}`,
+	`{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","request":{"uid":"2","kind":{"version":"v1","kind":"Pod"},"operation":"CREATE"}}`,
+	`{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","request":{"uid":"3","kind":{"group":"apps","version":"v1","kind":"Deployment"},` +
+		`"operation":"CREATE","object":{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"app"}}}}`,
+	`{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","request":{"uid":"4","kind":{"version":"v1","kind":"Pod"},` +
+		`"operation":"CREATE","object":{"spec":{"containers":"not a list"}}}}`,
+	`{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","request":{"uid":"5","kind":{"version":"v1","kind":"Pod"},` +
+		`"operation":"UPDATE","subResource":"ephemeralcontainers","object":{"metadata":{"name":"a"}}}}`,
+	`{"apiVersion":"admission.k8s.io/v1beta1","kind":"AdmissionReview"}`,
+	`not json`,
+	`{}`,
+}
+
+// FuzzServe checks serve never panics and answers with an HTTP error or a well-formed AdmissionReview
+func FuzzServe(f *testing.F) {
+	for _, seed := range admissionReviewSeeds {
+		f.Add(seed, "application/json")
+	}
+	f.Add(admissionReviewSeeds[0], "application/json; charset=utf-8")
+	f.Add(admissionReviewSeeds[0], "text/plain")
+	f.Add("", "application/json")
+
+	setNameConflictPolicy(f, nameConflictPolicyRename)
+	whsvr := newTestWebhookServer(testConflictConfig())
+	f.Fuzz(func(t *testing.T, body, contentType string) {
+		w, review := serveReview(t, whsvr, body, contentType)
+		if review == nil && (w.Code < 400 || w.Code > 599) {
+			t.Errorf("serve returned HTTP %d without an AdmissionReview", w.Code)
+		}
+	})
+}
+
+// FuzzMutate checks mutate never panics on arbitrary pod objects and only returns patches that apply
+func FuzzMutate(f *testing.F) {
+	f.Add([]byte(`{"apiVersion":"v1","kind":"Pod","metadata":{"name":"app","annotations":{"sidecar-injector-webhook.morven.me/inject":"yes"}},` +
+		`"spec":{"containers":[{"name":"sidecar"},{"name":"app","volumeMounts":[{"name":"data","mountPath":"/data"}]}],"volumes":[{"name":"data"}]}}`))
+	f.Add([]byte(`{"metadata":{"annotations":{"sidecar-injector-webhook.morven.me/status":"injected"}}}`))
+	f.Add([]byte(`{"spec":{"containers":null}}`))
+	f.Add([]byte(`null`))
+	f.Add([]byte(`[]`))
+	f.Add([]byte{})
+
+	setNameConflictPolicy(f, nameConflictPolicyRename)
+	whsvr := newTestWebhookServer(testConflictConfig())
+	f.Fuzz(func(t *testing.T, object []byte) {
+		for _, op := range []admissionv1.Operation{admissionv1.Create, admissionv1.Update} {
+			resp := whsvr.mutate(&admissionv1.AdmissionReview{Request: &admissionv1.AdmissionRequest{
+				UID:       "uid",
+				Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+				Operation: op,
+				Object:    runtime.RawExtension{Raw: object},
+			}})
+			if resp == nil {
+				t.Fatal("mutate returned no response")
+			}
+			if len(resp.Patch) == 0 {
+				continue
+			}
+			if !resp.Allowed {
+				t.Errorf("mutate denied the request with a patch")
+			}
+			var pod corev1.Pod
+			if err := json.Unmarshal(object, &pod); err != nil {
+				t.Fatalf("mutate patched an object that is not a pod: %v", err)
+			}
+			if _, err := applyPatch(&pod, resp.Patch); err != nil {
+				t.Errorf("mutate returned a patch %s that does not apply: %v", resp.Patch, err)
+			}
+		}
+	})
+}
+
+// benchmarkConfig returns a config injecting n sidecars, each with its own volume mounted into the pod
+func benchmarkConfig(n int) *Config {
+	cfg := &Config{ContainerPosition: containerPositionAppend, Labels: map[string]string{"sidecar-injected": "true"}}
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("sidecar-%d", i)
+		mount := corev1.VolumeMount{Name: name, MountPath: "/mnt/" + name}
+		cfg.Containers = append(cfg.Containers, corev1.Container{
+			Name:         name,
+			Image:        "registry.example.com/sidecar:v1",
+			Args:         []string{"--mount", mount.MountPath},
+			Env:          []corev1.EnvVar{{Name: "MOUNT_PATH", Value: mount.MountPath}},
+			VolumeMounts: []corev1.VolumeMount{mount},
+		})
+		cfg.Volumes = append(cfg.Volumes, corev1.Volume{
+			Name:         name,
+			VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+		})
+		cfg.appVolumeMounts = append(cfg.appVolumeMounts, mount)
+	}
+	return cfg
+}
+
+func BenchmarkCreatePatch(b *testing.B) {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", Labels: map[string]string{"app": "app"}},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app"}, {Name: "logger"}},
+			Volumes:    []corev1.Volume{{Name: "data"}},
+		},
+	}
+	annotations := map[string]string{admissionWebhookAnnotationStatusKey: "injected"}
+	for _, n := range []int{1, 10, 50} {
+		cfg := benchmarkConfig(n)
+		b.Run(fmt.Sprintf("sidecars=%d", n), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := createPatch(pod, cfg, annotations); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// patchTestConfig returns a config with two sidecars sharing a volume mounted into the pod
+// containers, and every optional pod field the injector patches set
+func patchTestConfig() *Config {
+	gracePeriod := int64(60)
+	return &Config{
+		Containers: []corev1.Container{
+			{Name: "sidecar", Image: "sidecar:v1", VolumeMounts: []corev1.VolumeMount{{Name: "shared", MountPath: "/shared"}}},
+			{Name: "logger", Image: "logger:v1"},
+		},
+		Volumes:                          []corev1.Volume{{Name: "shared", VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}},
+		ContainerPosition:                containerPositionAppend,
+		ImagePullSecrets:                 []corev1.LocalObjectReference{{Name: "registry"}},
+		MinTerminationGracePeriodSeconds: &gracePeriod,
+		Labels:                           map[string]string{"example.com/injected": "true"},
+		ReadinessGates:                   []string{"example.com/sidecar-ready"},
+		appVolumeMounts:                  []corev1.VolumeMount{{Name: "shared", MountPath: "/shared"}},
+	}
+}
+
+// patchTestPod returns a pod with two containers, a volume and a mount, and no annotations or labels
+func patchTestPod() *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "app", VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: "/data"}}},
+				{Name: "worker"},
+			},
+			Volumes: []corev1.Volume{{Name: "data"}},
+		},
+	}
+}
+
+func TestCreatePatchGolden(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      func(cfg *Config)
+		pod         func(pod *corev1.Pod)
+		annotations map[string]string
+	}{
+		{
+			name: "append",
+		},
+		{
+			name:   "prepend",
+			config: func(cfg *Config) { cfg.ContainerPosition = containerPositionPrepend },
+		},
+		{
+			name: "empty pod",
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.Containers = nil
+				pod.Spec.Volumes = nil
+			},
+		},
+		{
+			name:   "prepend into empty pod",
+			config: func(cfg *Config) { cfg.ContainerPosition = containerPositionPrepend },
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.Containers = nil
+				pod.Spec.Volumes = nil
+			},
+		},
+		{
+			name: "existing mounts and pod fields",
+			pod: func(pod *corev1.Pod) {
+				// the worker mounts another volume at the shared path, so it is skipped
+				pod.Spec.Containers[1].VolumeMounts = []corev1.VolumeMount{{Name: "data", MountPath: "/shared"}}
+				pod.Spec.ImagePullSecrets = []corev1.LocalObjectReference{{Name: "app-registry"}, {Name: "registry"}}
+				pod.Spec.ReadinessGates = []corev1.PodReadinessGate{{ConditionType: "example.com/app-ready"}}
+				gracePeriod := int64(10)
+				pod.Spec.TerminationGracePeriodSeconds = &gracePeriod
+			},
+		},
+		{
+			name: "existing annotations and labels",
+			pod: func(pod *corev1.Pod) {
+				pod.Annotations = map[string]string{admissionWebhookAnnotationInjectKey: "yes", admissionWebhookAnnotationStatusKey: "stale"}
+				pod.Labels = map[string]string{"app": "app", "example.com/injected": "false"}
+			},
+			annotations: map[string]string{
+				admissionWebhookAnnotationStatusKey:     "injected",
+				admissionWebhookAnnotationInjectedByKey: "injector-0",
+			},
+		},
+		{
+			name: "no sidecars",
+			config: func(cfg *Config) {
+				cfg.Containers = nil
+				cfg.Volumes = nil
+				cfg.appVolumeMounts = nil
+				cfg.ImagePullSecrets = nil
+				cfg.ReadinessGates = nil
+				cfg.MinTerminationGracePeriodSeconds = nil
+				cfg.Labels = nil
+			},
+		},
+		{
+			name: "extra patches",
+			config: func(cfg *Config) {
+				cfg.ExtraPatches = []patchOperation{{Op: "add", Path: "/spec/dnsPolicy", Value: "None"}}
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := patchTestConfig()
+			if tt.config != nil {
+				tt.config(cfg)
+			}
+			pod := patchTestPod()
+			if tt.pod != nil {
+				tt.pod(pod)
+			}
+			annotations := tt.annotations
+			if annotations == nil {
+				annotations = map[string]string{admissionWebhookAnnotationStatusKey: "injected"}
+			}
+
+			result, err := createPatch(pod, cfg, annotations)
+			if err != nil {
+				t.Fatalf("createPatch returned error: %v", err)
+			}
+			if _, err := applyPatch(pod, result.patch); err != nil {
+				t.Errorf("patch does not apply: %v", err)
+			}
+			var indented bytes.Buffer
+			if err := json.Indent(&indented, result.patch, "", "  "); err != nil {
+				t.Fatalf("createPatch returned invalid JSON %s: %v", result.patch, err)
+			}
+			indented.WriteByte('\n')
+			checkGolden(t, filepath.Join("createpatch", strings.ReplaceAll(tt.name, " ", "-")+".json"), indented.Bytes())
+		})
+	}
+}
+
+func TestWithReadOnlyMounts(t *testing.T) {
+	cfg := &Config{
+		Containers: []corev1.Container{{
+			Name:         "sidecar",
+			VolumeMounts: []corev1.VolumeMount{{Name: "scratch", MountPath: "/scratch"}},
+		}},
+		appVolumeMounts: []corev1.VolumeMount{
+			{Name: "scratch", MountPath: "/scratch"},
+			{Name: "reference", MountPath: "/reference", ReadOnly: true},
+		},
+	}
+
+	got := cfg.withReadOnlyMounts()
+	for _, m := range got.appVolumeMounts {
+		if !m.ReadOnly {
+			t.Errorf("pod container mount %s is not read-only", m.Name)
+		}
+	}
+	// the sidecars may have to write, e.g. to the scratch volume
+	if got.Containers[0].VolumeMounts[0].ReadOnly {
+		t.Errorf("sidecar mount %s was made read-only", got.Containers[0].VolumeMounts[0].Name)
+	}
+	if cfg.appVolumeMounts[0].ReadOnly {
+		t.Errorf("withReadOnlyMounts modified the config")
+	}
+}
+
+func TestMutateReadOnlyAll(t *testing.T) {
+	cfg := &Config{
+		Containers: []corev1.Container{{Name: "sidecar"}},
+		StaticMounts: []StaticMount{
+			{Volume: corev1.Volume{Name: "reference"}, MountPath: "/reference", ReadOnly: true},
+			{Volume: corev1.Volume{Name: "results"}, MountPath: "/results"},
+		},
+		ScratchVolume: &ScratchVolumeConfig{MountPath: "/scratch"},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	cfg.setScratchVolume()
+	cfg.setStaticMounts()
+
+	tests := []struct {
+		value        string
+		wantReadOnly bool
+		wantWarning  bool
+	}{
+		{value: "true", wantReadOnly: true},
+		{value: " True\n", wantReadOnly: true},
+		{value: "yes", wantReadOnly: true},
+		{value: "false"},
+		{value: "OFF"},
+		{value: "ture", wantWarning: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "app",
+					Namespace:   "default",
+					Annotations: map[string]string{admissionWebhookAnnotationReadOnlyAllKey: tt.value},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "app", VolumeMounts: []corev1.VolumeMount{{Name: "data", MountPath: "/data"}}}},
+					Volumes:    []corev1.Volume{{Name: "data"}},
+				},
+			}
+			resp := mutatePod(t, newTestWebhookServer(cfg), pod, admissionv1.Create)
+			mutated := patchedPod(t, pod, resp)
+
+			if n := len(mutated.Spec.Containers[0].VolumeMounts); n != 4 {
+				t.Fatalf("app container has %d mounts, want data, scratch, reference and results", n)
+			}
+			for _, m := range mutated.Spec.Containers[0].VolumeMounts {
+				switch {
+				case m.Name == "data":
+					if m.ReadOnly {
+						t.Errorf("the pod's own mount %s was made read-only", m.Name)
+					}
+				case m.Name == "reference":
+					// read-only in the config either way
+					if !m.ReadOnly {
+						t.Errorf("mount %s is not read-only", m.Name)
+					}
+				default:
+					if m.ReadOnly != tt.wantReadOnly {
+						t.Errorf("mount %s read-only = %v, want %v", m.Name, m.ReadOnly, tt.wantReadOnly)
+					}
+				}
+			}
+			for _, m := range mutated.Spec.Containers[1].VolumeMounts {
+				if m.ReadOnly {
+					t.Errorf("sidecar mount %s was made read-only", m.Name)
+				}
+			}
+			if gotWarning := len(resp.Warnings) > 0; gotWarning != tt.wantWarning {
+				t.Errorf("warnings = %q, want warning %v", resp.Warnings, tt.wantWarning)
+			}
+		})
+	}
+}
+
+// TestConfigSwapDuringMutate replaces the config while requests are mutated, every patch must
+// come from exactly one config version. Run it with -race.
+func TestConfigSwapDuringMutate(t *testing.T) {
+	versionConfig := func(version string) *Config {
+		cfg := &Config{
+			Containers:   []corev1.Container{{Name: "sidecar-" + version, Image: "sidecar:" + version}},
+			Volumes:      []corev1.Volume{{Name: "volume-" + version}},
+			Labels:       map[string]string{"version": version},
+			StaticMounts: []StaticMount{{Volume: corev1.Volume{Name: "static-" + version}, MountPath: "/static-" + version}},
+		}
+		if err := cfg.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		cfg.setStaticMounts()
+		return cfg
+	}
+	configs := []*Config{versionConfig("a"), versionConfig("b")}
+	whsvr := newTestWebhookServer(configs[0])
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+	}
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       "uid",
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Namespace: pod.Namespace,
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	var swapper sync.WaitGroup
+	swapper.Add(1)
+	go func() {
+		defer swapper.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+				whsvr.setConfig(configs[i%len(configs)])
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				r := httptest.NewRequest(http.MethodPost, webhookInjectPath, bytes.NewReader(body))
+				r.Header.Set("Content-Type", "application/json")
+				w := httptest.NewRecorder()
+				whsvr.serve(w, r)
+
+				var review admissionv1.AdmissionReview
+				if err := json.Unmarshal(w.Body.Bytes(), &review); err != nil || review.Response == nil {
+					t.Errorf("serve returned %q: %v", w.Body.String(), err)
+					return
+				}
+				mutated, err := applyPatch(pod, review.Response.Patch)
+				if err != nil {
+					t.Errorf("patch does not apply: %v", err)
+					return
+				}
+				version := mutated.Labels["version"]
+				want := []string{"app", "sidecar-" + version}
+				if got := containerNames(mutated.Spec.Containers); !reflect.DeepEqual(got, want) {
+					t.Errorf("version %q patch injected containers %v, want %v", version, got, want)
+				}
+				want = []string{"volume-" + version, "static-" + version}
+				if got := volumeNames(mutated.Spec.Volumes); !reflect.DeepEqual(got, want) {
+					t.Errorf("version %q patch injected volumes %v, want %v", version, got, want)
+				}
+				if mounts := mutated.Spec.Containers[0].VolumeMounts; len(mounts) != 1 || mounts[0].MountPath != "/static-"+version {
+					t.Errorf("version %q patch mounted %+v into the app", version, mounts)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	swapper.Wait()
+}
+
+func TestSidecarImageOverride(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	tests := []struct {
+		name          string
+		annotation    *string
+		requireDigest bool
+		want          string
+		wantErr       string
+	}{
+		{name: "no annotation"},
+		{name: "allowed registry", annotation: strPtr("registry.example.com/sidecar:debug"), want: "registry.example.com/sidecar:debug"},
+		{name: "allowed registry with port", annotation: strPtr("localhost:5000/sidecar:debug"), want: "localhost:5000/sidecar:debug"},
+		{name: "docker hub not allowed", annotation: strPtr("sidecar:debug"), wantErr: `registry "docker.io"`},
+		{name: "disallowed registry", annotation: strPtr("evil.example.com/sidecar:debug"), wantErr: `registry "evil.example.com"`},
+		{name: "empty", annotation: strPtr(""), wantErr: "invalid image reference"},
+		{name: "whitespace", annotation: strPtr(" registry.example.com/sidecar:debug"), wantErr: "invalid image reference"},
+		{name: "malformed tag", annotation: strPtr("registry.example.com/sidecar:-debug"), wantErr: "invalid tag"},
+		{name: "malformed repository", annotation: strPtr("registry.example.com/Sidecar:debug"), wantErr: "invalid repository"},
+		{name: "malformed digest", annotation: strPtr("registry.example.com/sidecar@sha256:abc"), wantErr: "invalid digest"},
+		{name: "digest required", annotation: strPtr("registry.example.com/sidecar:debug"), requireDigest: true, wantErr: "not referenced by digest"},
+		{name: "digest required and set", annotation: strPtr("registry.example.com/sidecar@" + digest), requireDigest: true, want: "registry.example.com/sidecar@" + digest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setAllowedImageRegistries(t, "registry.example.com", "localhost:5000")
+			setBoolFlag(t, &requireImageDigest, tt.requireDigest)
+			metadata := &metav1.ObjectMeta{Name: "app"}
+			if tt.annotation != nil {
+				metadata.Annotations = map[string]string{admissionWebhookAnnotationImageKey: *tt.annotation}
+			}
+
+			got, err := sidecarImageOverride(metadata)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("sidecarImageOverride = %q, %v, want error containing %q", got, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Errorf("sidecarImageOverride = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
+
+func TestWithSidecarImage(t *testing.T) {
+	cfg := &Config{Containers: []corev1.Container{
+		{Name: "sidecar", Image: "sidecar:v1", Env: []corev1.EnvVar{{Name: "A", Value: "a"}}},
+		{Name: "logger", Image: "logger:v1"},
+	}}
+	image := "registry.example.com/sidecar@sha256:" + strings.Repeat("a", 64)
+
+	got := cfg.withSidecarImage(image)
+	for _, c := range got.Containers {
+		if c.Image != image {
+			t.Errorf("container %s image = %q, want %q", c.Name, c.Image, image)
+		}
+	}
+	if cfg.Containers[0].Image != "sidecar:v1" || cfg.Containers[1].Image != "logger:v1" {
+		t.Errorf("withSidecarImage modified the config: %+v", cfg.Containers)
+	}
+	got.Containers[0].Env[0].Value = "changed"
+	if cfg.Containers[0].Env[0].Value != "a" {
+		t.Errorf("withSidecarImage shares the container env with the config")
+	}
+}
+
+func TestMutateSidecarImageOverride(t *testing.T) {
+	setAllowedImageRegistries(t, "registry.example.com")
+	cfg := &Config{Containers: []corev1.Container{{Name: "sidecar", Image: "sidecar:v1"}}}
+	whsvr := newTestWebhookServer(cfg)
+	tests := []struct {
+		name        string
+		image       string
+		wantImage   string
+		wantWarning bool
+	}{
+		{name: "allowed", image: "registry.example.com/sidecar:debug", wantImage: "registry.example.com/sidecar:debug"},
+		{name: "disallowed keeps the configured image", image: "evil.example.com/sidecar:debug", wantImage: "sidecar:v1", wantWarning: true},
+		{name: "malformed keeps the configured image", image: "registry.example.com/sidecar:", wantImage: "sidecar:v1", wantWarning: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", Annotations: map[string]string{admissionWebhookAnnotationImageKey: tt.image}},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+			}
+			resp := mutatePod(t, whsvr, pod, admissionv1.Create)
+			mutated := patchedPod(t, pod, resp)
+
+			sidecar := mutated.Spec.Containers[1]
+			if sidecar.Image != tt.wantImage {
+				t.Errorf("sidecar image = %q, want %q", sidecar.Image, tt.wantImage)
+			}
+			effective, ok := mutated.Annotations[admissionWebhookAnnotationEffectiveImageKey]
+			if tt.wantWarning {
+				if ok {
+					t.Errorf("effective image annotation %q set for a rejected override", effective)
+				}
+				if len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], admissionWebhookAnnotationImageKey) {
+					t.Errorf("warnings = %q, want one naming the annotation", resp.Warnings)
+				}
+			} else if effective != tt.wantImage {
+				t.Errorf("effective image annotation = %q, want %q", effective, tt.wantImage)
+			}
+			if cfg.Containers[0].Image != "sidecar:v1" {
+				t.Errorf("mutate modified the config image to %q", cfg.Containers[0].Image)
+			}
+		})
+	}
+}
+
+func TestStaleInjectionStatus(t *testing.T) {
+	cfg := &Config{Containers: []corev1.Container{{Name: "sidecar"}, {Name: "logger"}}}
+	injected := map[string]string{admissionWebhookAnnotationStatusKey: "injected"}
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		containers  []string
+		cfg         *Config
+		want        bool
+	}{
+		{name: "not injected", containers: []string{"app"}},
+		{name: "stale status without sidecars", annotations: injected, containers: []string{"app"}, want: true},
+		{name: "injected", annotations: injected, containers: []string{"app", "sidecar", "logger"}},
+		{name: "injected with one sidecar left", annotations: injected, containers: []string{"app", "logger"}},
+		{
+			name: "renamed sidecar recorded in the sidecars annotation",
+			annotations: map[string]string{
+				admissionWebhookAnnotationStatusKey:   "injected",
+				admissionWebhookAnnotationSidecarsKey: `[{"name":"sidecar-2","image":"sidecar"}]`,
+			},
+			containers: []string{"sidecar", "sidecar-2"},
+		},
+		{
+			name: "stale sidecars annotation",
+			annotations: map[string]string{
+				admissionWebhookAnnotationStatusKey:   "injected",
+				admissionWebhookAnnotationSidecarsKey: `[{"name":"sidecar-2","image":"sidecar"}]`,
+			},
+			containers: []string{"sidecar"},
+			want:       true,
+		},
+		{
+			name: "invalid sidecars annotation falls back to the config",
+			annotations: map[string]string{
+				admissionWebhookAnnotationStatusKey:   "injected",
+				admissionWebhookAnnotationSidecarsKey: `not json`,
+			},
+			containers: []string{"app"},
+			want:       true,
+		},
+		{name: "no sidecars configured", annotations: injected, containers: []string{"app"}, cfg: &Config{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app", Annotations: tt.annotations}}
+			for _, name := range tt.containers {
+				pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: name})
+			}
+			c := cfg
+			if tt.cfg != nil {
+				c = tt.cfg
+			}
+			if got := staleInjectionStatus(pod, c); got != tt.want {
+				t.Errorf("staleInjectionStatus = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMutateStaleInjectionStatus(t *testing.T) {
+	setBoolFlag(t, &injectOnUpdate, true)
+	whsvr := newTestWebhookServer(&Config{Containers: []corev1.Container{{Name: "sidecar"}}})
+	newPod := func(containers ...string) *corev1.Pod {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:        "app",
+			Namespace:   "default",
+			Annotations: map[string]string{admissionWebhookAnnotationStatusKey: "injected"},
+		}}
+		for _, name := range containers {
+			pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: name})
+		}
+		return pod
+	}
+	tests := []struct {
+		name       string
+		pod        *corev1.Pod
+		op         admissionv1.Operation
+		wantInject bool
+	}{
+		{name: "recreated pod with a stale status", pod: newPod("app"), op: admissionv1.Create, wantInject: true},
+		{name: "injected pod", pod: newPod("app", "sidecar"), op: admissionv1.Create},
+		// containers can't be added to an existing pod
+		{name: "update with a stale status", pod: newPod("app"), op: admissionv1.Update},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := mutatePod(t, whsvr, tt.pod, tt.op)
+			if (len(resp.Patch) > 0) != tt.wantInject {
+				t.Fatalf("patch = %s, want injection %v", resp.Patch, tt.wantInject)
+			}
+			if !tt.wantInject {
+				return
+			}
+			mutated := patchedPod(t, tt.pod, resp)
+			if got := containerNames(mutated.Spec.Containers); !reflect.DeepEqual(got, []string{"app", "sidecar"}) {
+				t.Errorf("containers = %v, want app and the sidecar", got)
+			}
+			if status := mutated.Annotations[admissionWebhookAnnotationStatusKey]; status != "injected" {
+				t.Errorf("status annotation = %q, want injected", status)
+			}
+		})
+	}
+}
+
+func TestCheckPatchOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		patch   []patchOperation
+		wantErr bool
+	}{
+		{name: "empty"},
+		{
+			name: "containers before mounts",
+			patch: []patchOperation{
+				{Op: "add", Path: "/spec/containers/0"},
+				{Op: "add", Path: "/spec/containers/-"},
+				{Op: "test", Path: "/spec/containers/2/name"},
+				{Op: "add", Path: "/spec/containers/2/volumeMounts/-"},
+				{Op: "add", Path: "/spec/volumes/-"},
+			},
+		},
+		{
+			name: "container added after a mount",
+			patch: []patchOperation{
+				{Op: "add", Path: "/spec/containers/0/volumeMounts/-"},
+				{Op: "add", Path: "/spec/containers/-"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "containers list created after a test",
+			patch: []patchOperation{
+				{Op: "test", Path: "/spec/containers/0/name"},
+				{Op: "add", Path: "/spec/containers"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "container removed after a mount",
+			patch: []patchOperation{
+				{Op: "add", Path: "/spec/containers/1/volumeMounts"},
+				{Op: "remove", Path: "/spec/containers/0"},
+			},
+			wantErr: true,
+		},
+		{
+			name: "other paths in between",
+			patch: []patchOperation{
+				{Op: "add", Path: "/spec/containers/0/volumeMounts/-"},
+				{Op: "add", Path: "/spec/initContainers/-"},
+				{Op: "add", Path: "/spec/containersExtra"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkPatchOrder(tt.patch)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkPatchOrder = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// patchStep returns the createPatch step of an operation, see createPatch
+func patchStep(op patchOperation) int {
+	switch {
+	case op.Path == "/spec/containers" || op.Path == "/spec/containers/-" || strings.Count(op.Path, "/") == 3 && strings.HasPrefix(op.Path, "/spec/containers/"):
+		return 1
+	case strings.HasPrefix(op.Path, "/spec/containers/"):
+		return 2
+	case strings.HasPrefix(op.Path, "/spec/"):
+		return 3
+	case strings.HasPrefix(op.Path, "/metadata/"):
+		return 4
+	}
+	return 5
+}
+
+func TestCreatePatchOrder(t *testing.T) {
+	cfg := patchTestConfig()
+	cfg.ContainerPosition = containerPositionPrepend
+	cfg.Labels = map[string]string{"a": "1", "b": "2", "c": "3", "d": "4"}
+	cfg.ExtraPatches = []patchOperation{{Op: "add", Path: "/spec/dnsPolicy", Value: "None"}}
+	pod := patchTestPod()
+	pod.Labels = map[string]string{"app": "app"}
+	pod.Annotations = map[string]string{"note": "x"}
+	annotations := map[string]string{admissionWebhookAnnotationStatusKey: "injected", admissionWebhookAnnotationInjectedByKey: "injector-0", "z": "1"}
+
+	first, err := createPatch(pod, cfg, annotations)
+	if err != nil {
+		t.Fatalf("createPatch returned error: %v", err)
+	}
+	// map iteration order must not leak into the patch
+	for i := 0; i < 20; i++ {
+		result, err := createPatch(pod, cfg, annotations)
+		if err != nil {
+			t.Fatalf("createPatch returned error: %v", err)
+		}
+		if !bytes.Equal(result.patch, first.patch) {
+			t.Fatalf("createPatch is not stable:\n%s\n%s", first.patch, result.patch)
+		}
+	}
+
+	var patch []patchOperation
+	if err := json.Unmarshal(first.patch, &patch); err != nil {
+		t.Fatal(err)
+	}
+	step := 0
+	for _, op := range patch {
+		if op.Path == "/spec/dnsPolicy" {
+			// the extra patch
+			step = 5
+			continue
+		}
+		s := patchStep(op)
+		if s < step {
+			t.Errorf("operation %s %s of step %d follows step %d", op.Op, op.Path, s, step)
+		}
+		step = s
+	}
+	if step != 5 {
+		t.Errorf("extra patch is not the last operation")
+	}
+	if err := checkPatchOrder(patch); err != nil {
+		t.Errorf("checkPatchOrder rejects the createPatch output: %v", err)
+	}
+	mutated, err := applyPatch(pod, first.patch)
+	if err != nil {
+		t.Fatalf("patch does not apply: %v", err)
+	}
+	// the prepended sidecars shift the pod containers, the mounts must still land on them
+	if got := containerNames(mutated.Spec.Containers); !reflect.DeepEqual(got, []string{"sidecar", "logger", "app", "worker"}) {
+		t.Errorf("containers = %v", got)
+	}
+	for _, c := range mutated.Spec.Containers[2:] {
+		if !hasVolumeMount(c.VolumeMounts, corev1.VolumeMount{Name: "shared"}) {
+			t.Errorf("pod container %s does not mount the shared volume", c.Name)
+		}
+	}
+	if hasVolumeMount(mutated.Spec.Containers[1].VolumeMounts, corev1.VolumeMount{Name: "shared"}) {
+		t.Errorf("mount meant for a pod container landed on sidecar logger")
+	}
+}
+
+func TestCreatePatchRejectsExtraContainerPatch(t *testing.T) {
+	cfg := patchTestConfig()
+	// validateExtraPatch keeps these out of a loaded config, createPatch checks the order regardless
+	cfg.ExtraPatches = []patchOperation{{Op: "add", Path: "/spec/containers/-", Value: map[string]string{"name": "late"}}}
+	result, err := createPatch(patchTestPod(), cfg, nil)
+	if err == nil {
+		t.Fatalf("createPatch accepted a container added after the mounts: %s", result.patch)
+	}
+	if result.operations == 0 || result.patch != nil {
+		t.Errorf("result = %+v, want the operation count only", result)
+	}
+}
+
+func TestAddVolumeMounts(t *testing.T) {
+	added := []corev1.VolumeMount{
+		{Name: "shared", MountPath: "/shared"},
+		{Name: "cache", MountPath: "/cache"},
+	}
+	tests := []struct {
+		name     string
+		existing []corev1.VolumeMount
+		index    int
+		want     []patchOperation
+	}{
+		{
+			name: "no mounts",
+			want: []patchOperation{
+				{Op: "test", Path: "/spec/containers/0/name", Value: "app"},
+				{Op: "add", Path: "/spec/containers/0/volumeMounts", Value: []corev1.VolumeMount{added[0]}},
+				{Op: "add", Path: "/spec/containers/0/volumeMounts/-", Value: &added[1]},
+			},
+		},
+		{
+			name:     "other mounts",
+			existing: []corev1.VolumeMount{{Name: "data", MountPath: "/data"}},
+			want: []patchOperation{
+				{Op: "test", Path: "/spec/containers/0/name", Value: "app"},
+				{Op: "add", Path: "/spec/containers/0/volumeMounts/-", Value: &added[0]},
+				{Op: "add", Path: "/spec/containers/0/volumeMounts/-", Value: &added[1]},
+			},
+		},
+		{
+			name:     "name clash",
+			existing: []corev1.VolumeMount{{Name: "shared", MountPath: "/elsewhere"}},
+			want: []patchOperation{
+				{Op: "test", Path: "/spec/containers/0/name", Value: "app"},
+				{Op: "add", Path: "/spec/containers/0/volumeMounts/-", Value: &added[1]},
+			},
+		},
+		{
+			name:     "path clash",
+			existing: []corev1.VolumeMount{{Name: "app-cache", MountPath: "/cache"}},
+			want: []patchOperation{
+				{Op: "test", Path: "/spec/containers/0/name", Value: "app"},
+				{Op: "add", Path: "/spec/containers/0/volumeMounts/-", Value: &added[0]},
+			},
+		},
+		{
+			name:     "all mounted",
+			existing: []corev1.VolumeMount{{Name: "shared", MountPath: "/shared"}, {Name: "app-cache", MountPath: "/cache"}},
+		},
+		{
+			name:  "shifted by prepended sidecars",
+			index: 2,
+			want: []patchOperation{
+				{Op: "test", Path: "/spec/containers/2/name", Value: "app"},
+				{Op: "add", Path: "/spec/containers/2/volumeMounts", Value: []corev1.VolumeMount{added[0]}},
+				{Op: "add", Path: "/spec/containers/2/volumeMounts/-", Value: &added[1]},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &corev1.Container{Name: "app", VolumeMounts: tt.existing}
+			got := addVolumeMounts(nil, c, tt.index, added, "/spec/containers")
+			if !reflect.DeepEqual(got, tt.want) {
+				gotJSON, _ := json.Marshal(got)
+				wantJSON, _ := json.Marshal(tt.want)
+				t.Errorf("addVolumeMounts = %s\nwant %s", gotJSON, wantJSON)
+			}
+		})
+	}
+}
+
+func TestAddVolumeMountsTestOperation(t *testing.T) {
+	added := []corev1.VolumeMount{{Name: "shared", MountPath: "/shared"}}
+	pod := &corev1.Pod{Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "sidecar"}, {Name: "app"}}}}
+
+	// the index of app in the pod the patch is applied to
+	patch, err := json.Marshal(addVolumeMounts(nil, &corev1.Container{Name: "app"}, 1, added, "/spec/containers"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mutated, err := applyPatch(pod, patch)
+	if err != nil {
+		t.Fatalf("patch does not apply: %v", err)
+	}
+	if len(mutated.Spec.Containers[1].VolumeMounts) != 1 || len(mutated.Spec.Containers[0].VolumeMounts) != 0 {
+		t.Errorf("mount added to the wrong container: %+v", mutated.Spec.Containers)
+	}
+
+	// a stale index must make the whole patch fail instead of mounting into another container
+	patch, err = json.Marshal(addVolumeMounts(nil, &corev1.Container{Name: "app"}, 0, added, "/spec/containers"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := applyPatch(pod, patch); err == nil {
+		t.Errorf("patch with a stale container index applied")
+	}
+}
+
+// patchJSON encodes the patch operations for comparison in the tests
+func patchJSON(t *testing.T, patch []patchOperation) string {
+	t.Helper()
+	if len(patch) == 0 {
+		return "[]"
+	}
+	b, err := json.Marshal(patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestAddImagePullSecret(t *testing.T) {
+	added := []corev1.LocalObjectReference{{Name: "registry"}, {Name: "mirror"}}
+	tests := []struct {
+		name     string
+		existing []corev1.LocalObjectReference
+		want     string
+	}{
+		{
+			name: "no pull secrets",
+			want: `[{"op":"add","path":"/spec/imagePullSecrets","value":[{"name":"registry"}]},` +
+				`{"op":"add","path":"/spec/imagePullSecrets/-","value":{"name":"mirror"}}]`,
+		},
+		{
+			name:     "unrelated pull secrets",
+			existing: []corev1.LocalObjectReference{{Name: "app-registry"}},
+			want: `[{"op":"add","path":"/spec/imagePullSecrets/-","value":{"name":"registry"}},` +
+				`{"op":"add","path":"/spec/imagePullSecrets/-","value":{"name":"mirror"}}]`,
+		},
+		{
+			name:     "secret already present",
+			existing: []corev1.LocalObjectReference{{Name: "registry"}},
+			want:     `[{"op":"add","path":"/spec/imagePullSecrets/-","value":{"name":"mirror"}}]`,
+		},
+		{
+			name:     "all present",
+			existing: []corev1.LocalObjectReference{{Name: "mirror"}, {Name: "registry"}},
+			want:     `[]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := addImagePullSecret(nil, tt.existing, added, "/spec/imagePullSecrets")
+			if gotJSON := patchJSON(t, got); gotJSON != tt.want {
+				t.Errorf("addImagePullSecret = %s\nwant %s", gotJSON, tt.want)
+			}
+
+			// the patch applies and references every secret once
+			pod := &corev1.Pod{Spec: corev1.PodSpec{ImagePullSecrets: tt.existing}}
+			mutated, err := applyPatch(pod, []byte(patchJSON(t, got)))
+			if err != nil {
+				t.Fatalf("patch does not apply: %v", err)
+			}
+			seen := map[string]int{}
+			for _, secret := range mutated.Spec.ImagePullSecrets {
+				seen[secret.Name]++
+			}
+			for _, secret := range append(tt.existing, added...) {
+				if seen[secret.Name] != 1 {
+					t.Errorf("pull secret %s referenced %d times, want once: %v", secret.Name, seen[secret.Name], mutated.Spec.ImagePullSecrets)
+				}
+			}
+		})
+	}
+}
+
+func TestAddImagePullSecretDuplicates(t *testing.T) {
+	added := []corev1.LocalObjectReference{{Name: "registry"}, {Name: "registry"}}
+	want := `[{"op":"add","path":"/spec/imagePullSecrets","value":[{"name":"registry"}]}]`
+	if got := patchJSON(t, addImagePullSecret(nil, nil, added, "/spec/imagePullSecrets")); got != want {
+		t.Errorf("addImagePullSecret = %s\nwant %s", got, want)
+	}
+}
+
+func int64Ptr(v int64) *int64 {
+	return &v
+}
+
+func TestRaiseTerminationGracePeriod(t *testing.T) {
+	tests := []struct {
+		name    string
+		current *int64
+		min     *int64
+		want    string
+	}{
+		{name: "not configured", current: int64Ptr(10), want: `[]`},
+		{name: "unset below the default", min: int64Ptr(20), want: `[]`},
+		{name: "unset", min: int64Ptr(60), want: `[{"op":"add","path":"/spec/terminationGracePeriodSeconds","value":60}]`},
+		{name: "lower", current: int64Ptr(10), min: int64Ptr(60), want: `[{"op":"add","path":"/spec/terminationGracePeriodSeconds","value":60}]`},
+		{name: "zero", current: int64Ptr(0), min: int64Ptr(60), want: `[{"op":"add","path":"/spec/terminationGracePeriodSeconds","value":60}]`},
+		{name: "equal", current: int64Ptr(60), min: int64Ptr(60), want: `[]`},
+		{name: "higher", current: int64Ptr(120), min: int64Ptr(60), want: `[]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := raiseTerminationGracePeriod(nil, tt.current, tt.min, "/spec/terminationGracePeriodSeconds")
+			if gotJSON := patchJSON(t, got); gotJSON != tt.want {
+				t.Errorf("raiseTerminationGracePeriod = %s\nwant %s", gotJSON, tt.want)
+			}
+
+			pod := &corev1.Pod{Spec: corev1.PodSpec{TerminationGracePeriodSeconds: tt.current}}
+			mutated, err := applyPatch(pod, []byte(patchJSON(t, got)))
+			if err != nil {
+				t.Fatalf("patch does not apply: %v", err)
+			}
+			want := tt.current
+			if len(got) > 0 {
+				want = tt.min
+			}
+			if !reflect.DeepEqual(mutated.Spec.TerminationGracePeriodSeconds, want) {
+				t.Errorf("terminationGracePeriodSeconds = %v, want %v", mutated.Spec.TerminationGracePeriodSeconds, want)
+			}
+		})
+	}
+}
+
+// loadTestConfig loads the YAML configuration the way the injector does on startup
+func loadTestConfig(t *testing.T, config string) *Config {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "sidecarconfig.yaml")
+	if err := ioutil.WriteFile(file, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadConfig(file)
+	if err != nil {
+		t.Fatalf("loadConfig returned error: %v", err)
+	}
+	return cfg
+}
+
+func findContainer(containers []corev1.Container, name string) *corev1.Container {
+	for i := range containers {
+		if containers[i].Name == name {
+			return &containers[i]
+		}
+	}
+	return nil
+}
+
+func TestSetProxyEnv(t *testing.T) {
+	cfg := loadTestConfig(t, `
+containers:
+- name: sidecar
+  image: sidecar
+- name: proxy-aware
+  image: proxy-aware
+  env:
+  - name: HTTP_PROXY
+    value: http://sidecar-proxy:3128
+  - name: NO_PROXY
+    valueFrom:
+      configMapKeyRef:
+        name: proxy
+        key: no-proxy
+proxy:
+  httpProxy: http://proxy.example.com:3128
+  noProxy: .cluster.local,10.0.0.0/8
+`)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "test-ns"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+	}
+	mutated := patchedPod(t, pod, mutatePod(t, newTestWebhookServer(cfg), pod, admissionv1.Create))
+
+	tests := []struct {
+		container string
+		want      []corev1.EnvVar
+	}{
+		{
+			container: "sidecar",
+			want: []corev1.EnvVar{
+				{Name: "HTTP_PROXY", Value: "http://proxy.example.com:3128"},
+				{Name: "NO_PROXY", Value: ".cluster.local,10.0.0.0/8"},
+			},
+		},
+		{
+			// the template variables win, HTTPS_PROXY is not configured
+			container: "proxy-aware",
+			want: []corev1.EnvVar{
+				{Name: "HTTP_PROXY", Value: "http://sidecar-proxy:3128"},
+				{Name: "NO_PROXY", ValueFrom: &corev1.EnvVarSource{ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "proxy"},
+					Key:                  "no-proxy",
+				}}},
+			},
+		},
+		{
+			container: "app",
+		},
+	}
+	for _, tt := range tests {
+		c := findContainer(mutated.Spec.Containers, tt.container)
+		if c == nil {
+			t.Fatalf("containers = %v, want %s", containerNames(mutated.Spec.Containers), tt.container)
+		}
+		if !reflect.DeepEqual(c.Env, tt.want) {
+			t.Errorf("%s env = %+v, want %+v", tt.container, c.Env, tt.want)
+		}
+	}
+}
+
+func TestSetScratchVolume(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    string
+		volume    string
+		sizeLimit string
+	}{
+		{
+			name: "defaults",
+			config: `
+scratchVolume:
+  mountPath: /scratch
+`,
+			volume: "sidecar-scratch",
+		},
+		{
+			name: "named with size limit",
+			config: `
+scratchVolume:
+  name: shared-tmp
+  mountPath: /scratch
+  sizeLimit: 512Mi
+`,
+			volume:    "shared-tmp",
+			sizeLimit: "512Mi",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadTestConfig(t, "containers:\n- name: sidecar\n  image: sidecar\n"+tt.config)
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "test-ns"},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}, {Name: "worker"}}},
+			}
+			mutated := patchedPod(t, pod, mutatePod(t, newTestWebhookServer(cfg), pod, admissionv1.Create))
+
+			want := corev1.Volume{Name: tt.volume, VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}}
+			if tt.sizeLimit != "" {
+				sizeLimit := resource.MustParse(tt.sizeLimit)
+				want.EmptyDir.SizeLimit = &sizeLimit
+			}
+			if !reflect.DeepEqual(mutated.Spec.Volumes, []corev1.Volume{want}) {
+				t.Errorf("volumes = %+v, want %+v", mutated.Spec.Volumes, want)
+			}
+
+			// both the sidecar and the pod containers mount it
+			mount := []corev1.VolumeMount{{Name: tt.volume, MountPath: "/scratch"}}
+			for _, c := range mutated.Spec.Containers {
+				if !reflect.DeepEqual(c.VolumeMounts, mount) {
+					t.Errorf("%s mounts = %+v, want %+v", c.Name, c.VolumeMounts, mount)
+				}
+			}
+			if len(mutated.Spec.Containers) != 3 {
+				t.Errorf("containers = %v, want the sidecar injected", containerNames(mutated.Spec.Containers))
+			}
+		})
+	}
+}
+
+func TestUpdateMap(t *testing.T) {
+	tests := []struct {
+		name   string
+		target map[string]string
+		added  map[string]string
+		want   string
+	}{
+		{
+			name:  "nil map",
+			added: map[string]string{"team": "data", "example.com/injected": "true"},
+			want:  `[{"op":"add","path":"/metadata/labels","value":{"example.com/injected":"true","team":"data"}}]`,
+		},
+		{
+			name:   "empty map",
+			target: map[string]string{},
+			added:  map[string]string{"team": "data"},
+			want:   `[{"op":"add","path":"/metadata/labels","value":{"team":"data"}}]`,
+		},
+		{
+			name:   "nothing added",
+			target: map[string]string{"app": "app"},
+			want:   `[]`,
+		},
+		{
+			name:   "existing keys",
+			target: map[string]string{"app": "app", "team": "web"},
+			added:  map[string]string{"team": "data", "tier": "backend"},
+			want: `[{"op":"replace","path":"/metadata/labels/team","value":"data"},` +
+				`{"op":"add","path":"/metadata/labels/tier","value":"backend"}]`,
+		},
+		{
+			name:   "escaped keys",
+			target: map[string]string{"app": "app", "example.com/injected": "false"},
+			added:  map[string]string{"example.com/injected": "true", "example.com/owner~team": "data"},
+			want: `[{"op":"replace","path":"/metadata/labels/example.com~1injected","value":"true"},` +
+				`{"op":"add","path":"/metadata/labels/example.com~1owner~0team","value":"data"}]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := updateMap(nil, tt.target, tt.added, "/metadata/labels")
+			if gotJSON := patchJSON(t, got); gotJSON != tt.want {
+				t.Errorf("updateMap = %s\nwant %s", gotJSON, tt.want)
+			}
+
+			// the patch merges the added entries and keeps the others
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Labels: tt.target}}
+			mutated, err := applyPatch(pod, []byte(patchJSON(t, got)))
+			if err != nil {
+				t.Fatalf("patch does not apply: %v", err)
+			}
+			want := map[string]string{}
+			for key, value := range tt.target {
+				want[key] = value
+			}
+			for key, value := range tt.added {
+				want[key] = value
+			}
+			if len(want) == 0 {
+				want = nil
+			}
+			if !reflect.DeepEqual(mutated.Labels, want) {
+				t.Errorf("labels = %v, want %v", mutated.Labels, want)
+			}
+		})
+	}
+}
+
+func TestSidecarCountLabel(t *testing.T) {
+	tests := []struct {
+		name      string
+		labels    map[string]string
+		sidecars  int
+		wantCount string
+	}{
+		{name: "pod without labels", sidecars: 2, wantCount: "2"},
+		{name: "pod with labels", labels: map[string]string{"app": "app"}, sidecars: 1, wantCount: "1"},
+		{name: "count already set", labels: map[string]string{sidecarCountLabelKey: "5"}, sidecars: 3, wantCount: "3"},
+		{name: "no sidecars", labels: map[string]string{"app": "app"}},
+		{name: "no sidecars nor labels"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := benchmarkConfig(tt.sidecars)
+			if tt.sidecars == 0 {
+				cfg.Labels = nil
+			}
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "test-ns", Labels: tt.labels},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+			}
+			mutated := patchedPod(t, pod, mutatePod(t, newTestWebhookServer(cfg), pod, admissionv1.Create))
+
+			count, ok := mutated.Labels[sidecarCountLabelKey]
+			if tt.wantCount == "" {
+				if ok {
+					t.Errorf("%s label = %q, want unset without sidecars", sidecarCountLabelKey, count)
+				}
+			} else if count != tt.wantCount {
+				t.Errorf("%s label = %q, want %q", sidecarCountLabelKey, count, tt.wantCount)
+			}
+			for key, value := range tt.labels {
+				if key != sidecarCountLabelKey && mutated.Labels[key] != value {
+					t.Errorf("label %s = %q, want %q kept", key, mutated.Labels[key], value)
+				}
+			}
+		})
+	}
+}
+
+func TestWithSidecarInfoVolume(t *testing.T) {
+	setSidecarInfoPath(t, "/etc/sidecar-injector")
+	cfg := patchTestConfig()
+	info := cfg.withSidecarInfoVolume()
+
+	wantVolume := corev1.Volume{
+		Name: "sidecar-injector-info",
+		VolumeSource: corev1.VolumeSource{
+			DownwardAPI: &corev1.DownwardAPIVolumeSource{
+				Items: []corev1.DownwardAPIVolumeFile{{
+					Path:     "sidecars.json",
+					FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.annotations['sidecar-injector-webhook.morven.me/sidecars']"},
+				}},
+			},
+		},
+	}
+	if got := info.Volumes[len(info.Volumes)-1]; !reflect.DeepEqual(got, wantVolume) {
+		t.Errorf("info volume = %+v, want %+v", got, wantVolume)
+	}
+	wantMount := corev1.VolumeMount{Name: "sidecar-injector-info", MountPath: "/etc/sidecar-injector", ReadOnly: true}
+	if got := info.appVolumeMounts[len(info.appVolumeMounts)-1]; got != wantMount {
+		t.Errorf("info mount = %+v, want %+v", got, wantMount)
+	}
+
+	// the loaded config is left as is
+	if len(info.Volumes) != len(cfg.Volumes)+1 || hasVolume(cfg.Volumes, "sidecar-injector-info") {
+		t.Errorf("volumes = %v, config volumes = %v", volumeNames(info.Volumes), volumeNames(cfg.Volumes))
+	}
+	if len(info.appVolumeMounts) != len(cfg.appVolumeMounts)+1 {
+		t.Errorf("appVolumeMounts = %+v, config appVolumeMounts = %+v", info.appVolumeMounts, cfg.appVolumeMounts)
+	}
+}
+
+func TestMutateSidecarInfoVolume(t *testing.T) {
+	setBoolFlag(t, &sidecarInfoVolume, true)
+	setSidecarInfoPath(t, "/var/run/sidecars")
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "test-ns"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+	}
+	mutated := patchedPod(t, pod, mutatePod(t, newTestWebhookServer(patchTestConfig()), pod, admissionv1.Create))
+
+	// the file content is the sidecars annotation the downward API volume exposes
+	want := `[{"name":"sidecar","image":"sidecar:v1","mountPaths":["/shared"]},{"name":"logger","image":"logger:v1"}]`
+	if got := mutated.Annotations[admissionWebhookAnnotationSidecarsKey]; got != want {
+		t.Errorf("sidecars annotation = %s\nwant %s", got, want)
+	}
+	if !hasVolume(mutated.Spec.Volumes, "sidecar-injector-info") {
+		t.Errorf("volumes = %v, want sidecar-injector-info", volumeNames(mutated.Spec.Volumes))
+	}
+	app := findContainer(mutated.Spec.Containers, "app")
+	if !hasVolumeMount(app.VolumeMounts, corev1.VolumeMount{Name: "sidecar-injector-info", MountPath: "/var/run/sidecars"}) {
+		t.Errorf("app mounts = %+v, want the info volume at /var/run/sidecars", app.VolumeMounts)
+	}
+}
+
+func TestAddReadinessGate(t *testing.T) {
+	added := []string{"example.com/sidecar-ready", "example.com/mounts-ready"}
+	tests := []struct {
+		name     string
+		existing []corev1.PodReadinessGate
+		want     string
+	}{
+		{
+			name: "no readiness gates",
+			want: `[{"op":"add","path":"/spec/readinessGates","value":[{"conditionType":"example.com/sidecar-ready"}]},` +
+				`{"op":"add","path":"/spec/readinessGates/-","value":{"conditionType":"example.com/mounts-ready"}}]`,
+		},
+		{
+			name:     "unrelated readiness gates",
+			existing: []corev1.PodReadinessGate{{ConditionType: "example.com/app-ready"}},
+			want: `[{"op":"add","path":"/spec/readinessGates/-","value":{"conditionType":"example.com/sidecar-ready"}},` +
+				`{"op":"add","path":"/spec/readinessGates/-","value":{"conditionType":"example.com/mounts-ready"}}]`,
+		},
+		{
+			name:     "gate already present",
+			existing: []corev1.PodReadinessGate{{ConditionType: "example.com/sidecar-ready"}},
+			want:     `[{"op":"add","path":"/spec/readinessGates/-","value":{"conditionType":"example.com/mounts-ready"}}]`,
+		},
+		{
+			name:     "all present",
+			existing: []corev1.PodReadinessGate{{ConditionType: "example.com/mounts-ready"}, {ConditionType: "example.com/sidecar-ready"}},
+			want:     `[]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := addReadinessGate(nil, tt.existing, added, "/spec/readinessGates")
+			if gotJSON := patchJSON(t, got); gotJSON != tt.want {
+				t.Errorf("addReadinessGate = %s\nwant %s", gotJSON, tt.want)
+			}
+
+			// the patch applies and lists every gate once
+			pod := &corev1.Pod{Spec: corev1.PodSpec{ReadinessGates: tt.existing}}
+			mutated, err := applyPatch(pod, []byte(patchJSON(t, got)))
+			if err != nil {
+				t.Fatalf("patch does not apply: %v", err)
+			}
+			seen := map[corev1.PodConditionType]int{}
+			for _, gate := range mutated.Spec.ReadinessGates {
+				seen[gate.ConditionType]++
+			}
+			for _, conditionType := range added {
+				if seen[corev1.PodConditionType(conditionType)] != 1 {
+					t.Errorf("readiness gate %s listed %d times, want once: %v", conditionType, seen[corev1.PodConditionType(conditionType)], mutated.Spec.ReadinessGates)
+				}
+			}
+			if len(mutated.Spec.ReadinessGates) != len(seen) {
+				t.Errorf("readiness gates = %v, want no duplicates", mutated.Spec.ReadinessGates)
+			}
+		})
+	}
+}
+
+func TestAddReadinessGateDuplicates(t *testing.T) {
+	want := `[{"op":"add","path":"/spec/readinessGates","value":[{"conditionType":"example.com/sidecar-ready"}]}]`
+	got := addReadinessGate(nil, nil, []string{"example.com/sidecar-ready", "example.com/sidecar-ready"}, "/spec/readinessGates")
+	if gotJSON := patchJSON(t, got); gotJSON != want {
+		t.Errorf("addReadinessGate = %s\nwant %s", gotJSON, want)
+	}
+}
+
+func TestValidateExtraPatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		op      patchOperation
+		wantErr string
+	}{
+		{name: "add", op: patchOperation{Op: "add", Path: "/spec/dnsPolicy", Value: "None"}},
+		{name: "replace", op: patchOperation{Op: "replace", Path: "/spec/priorityClassName", Value: "high"}},
+		{name: "remove", op: patchOperation{Op: "remove", Path: "/spec/nodeSelector"}},
+		{name: "test", op: patchOperation{Op: "test", Path: "/spec/restartPolicy", Value: "Always"}},
+		{name: "move", op: patchOperation{Op: "move", From: "/spec/nodeSelector", Path: "/spec/affinity"}},
+		{name: "copy", op: patchOperation{Op: "copy", From: "/spec/hostname", Path: "/spec/subdomain"}},
+		{
+			name:    "invalid op",
+			op:      patchOperation{Op: "merge", Path: "/spec/dnsPolicy", Value: "None"},
+			wantErr: `invalid op "merge"`,
+		},
+		{
+			name:    "missing op",
+			op:      patchOperation{Path: "/spec/dnsPolicy", Value: "None"},
+			wantErr: `invalid op ""`,
+		},
+		{
+			name:    "add without value",
+			op:      patchOperation{Op: "add", Path: "/spec/dnsPolicy"},
+			wantErr: "add operation needs a value",
+		},
+		{
+			name:    "relative path",
+			op:      patchOperation{Op: "add", Path: "spec/dnsPolicy", Value: "None"},
+			wantErr: `path "spec/dnsPolicy" must start with /`,
+		},
+		{
+			name:    "move without from",
+			op:      patchOperation{Op: "move", Path: "/spec/affinity"},
+			wantErr: "move operation needs a from path starting with /",
+		},
+		{
+			name:    "copy with relative from",
+			op:      patchOperation{Op: "copy", From: "spec/hostname", Path: "/spec/subdomain"},
+			wantErr: "copy operation needs a from path starting with /",
+		},
+		{
+			name:    "generated path",
+			op:      patchOperation{Op: "replace", Path: "/spec/terminationGracePeriodSeconds", Value: 10},
+			wantErr: `path "/spec/terminationGracePeriodSeconds" conflicts with the patched /spec/terminationGracePeriodSeconds`,
+		},
+		{
+			name:    "under a generated path",
+			op:      patchOperation{Op: "add", Path: "/spec/containers/0/env/-", Value: map[string]string{"name": "A"}},
+			wantErr: `path "/spec/containers/0/env/-" conflicts with the patched /spec/containers`,
+		},
+		{
+			name:    "parent of a generated path",
+			op:      patchOperation{Op: "replace", Path: "/metadata", Value: map[string]string{}},
+			wantErr: `path "/metadata" conflicts with the patched /metadata/annotations`,
+		},
+		{
+			name:    "generated path as from",
+			op:      patchOperation{Op: "copy", From: "/metadata/labels", Path: "/spec/nodeSelector"},
+			wantErr: `path "/metadata/labels" conflicts with the patched /metadata/labels`,
+		},
+		{
+			name:    "moved into a generated path",
+			op:      patchOperation{Op: "move", From: "/spec/nodeSelector", Path: "/spec/volumes/0"},
+			wantErr: `path "/spec/volumes/0" conflicts with the patched /spec/volumes`,
+		},
+		{
+			// a shared prefix is not a conflict
+			name: "similar path",
+			op:   patchOperation{Op: "add", Path: "/spec/containersReady", Value: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateExtraPatch(&tt.op)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateExtraPatch returned error: %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("validateExtraPatch = %v, want error %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestExtraPatchesAppendedOnInjection(t *testing.T) {
+	cfg := loadTestConfig(t, `
+containers:
+- name: sidecar
+  image: sidecar
+labels:
+  example.com/injected: "true"
+extraPatches:
+- op: add
+  path: /spec/dnsConfig
+  value:
+    options:
+    - name: ndots
+      value: "2"
+- op: add
+  path: /spec/priorityClassName
+  value: sidecar-injected
+`)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "test-ns"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+	}
+	resp := mutatePod(t, newTestWebhookServer(cfg), pod, admissionv1.Create)
+
+	var ops []patchOperation
+	if err := json.Unmarshal(resp.Patch, &ops); err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) < 2 || ops[len(ops)-2].Path != "/spec/dnsConfig" || ops[len(ops)-1].Path != "/spec/priorityClassName" {
+		t.Errorf("patch = %s, want the extra patches appended last", resp.Patch)
+	}
+
+	mutated := patchedPod(t, pod, resp)
+	ndots := "2"
+	wantDNS := &corev1.PodDNSConfig{Options: []corev1.PodDNSConfigOption{{Name: "ndots", Value: &ndots}}}
+	if !reflect.DeepEqual(mutated.Spec.DNSConfig, wantDNS) {
+		t.Errorf("dnsConfig = %+v, want %+v", mutated.Spec.DNSConfig, wantDNS)
+	}
+	if mutated.Spec.PriorityClassName != "sidecar-injected" {
+		t.Errorf("priorityClassName = %q, want sidecar-injected", mutated.Spec.PriorityClassName)
+	}
+	if mutated.Labels["example.com/injected"] != "true" || len(mutated.Spec.Containers) != 2 {
+		t.Errorf("labels = %v, containers = %v, want the injection kept", mutated.Labels, containerNames(mutated.Spec.Containers))
+	}
+}
+
+func TestLoadConfigRejectsExtraPatch(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "sidecarconfig.yaml")
+	config := `
+containers:
+- name: sidecar
+  image: sidecar
+extraPatches:
+- op: add
+  path: /spec/dnsPolicy
+  value: None
+- op: add
+  path: /metadata/labels/team
+  value: data
+`
+	if err := ioutil.WriteFile(file, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want := `extraPatches[1]: path "/metadata/labels/team" conflicts with the patched /metadata/labels`
+	if _, err := loadConfig(file); err == nil || err.Error() != want {
+		t.Errorf("loadConfig = %v, want error %q", err, want)
+	}
+}
+
+func TestSetStaticMounts(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      string
+		wantVolumes []corev1.Volume
+		wantMounts  []corev1.VolumeMount
+	}{
+		{
+			name: "one static mount",
+			config: `
+staticMounts:
+- volume:
+    name: reference
+    persistentVolumeClaim:
+      claimName: reference-data
+      readOnly: true
+  mountPath: /reference
+  readOnly: true
+`,
+			wantVolumes: []corev1.Volume{{
+				Name:         "reference",
+				VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "reference-data", ReadOnly: true}},
+			}},
+			wantMounts: []corev1.VolumeMount{{Name: "reference", MountPath: "/reference", ReadOnly: true}},
+		},
+		{
+			name: "several static mounts",
+			config: `
+staticMounts:
+- volume:
+    name: reference
+    persistentVolumeClaim:
+      claimName: reference-data
+  mountPath: /reference
+  subPath: v2
+  readOnly: true
+- volume:
+    name: certs
+    configMap:
+      name: ca-certs
+  mountPath: /etc/ssl/certs
+`,
+			wantVolumes: []corev1.Volume{
+				{
+					Name:         "reference",
+					VolumeSource: corev1.VolumeSource{PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{ClaimName: "reference-data"}},
+				},
+				{
+					Name:         "certs",
+					VolumeSource: corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{LocalObjectReference: corev1.LocalObjectReference{Name: "ca-certs"}}},
+				},
+			},
+			wantMounts: []corev1.VolumeMount{
+				{Name: "reference", MountPath: "/reference", SubPath: "v2", ReadOnly: true},
+				{Name: "certs", MountPath: "/etc/ssl/certs"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadTestConfig(t, "containers:\n- name: sidecar\n  image: sidecar\n"+tt.config)
+			if !reflect.DeepEqual(cfg.Volumes, tt.wantVolumes) {
+				t.Errorf("volumes = %+v, want %+v", cfg.Volumes, tt.wantVolumes)
+			}
+			if !reflect.DeepEqual(cfg.appVolumeMounts, tt.wantMounts) {
+				t.Errorf("appVolumeMounts = %+v, want %+v", cfg.appVolumeMounts, tt.wantMounts)
+			}
+
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "test-ns"},
+				Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}, {Name: "worker"}}},
+			}
+			mutated := patchedPod(t, pod, mutatePod(t, newTestWebhookServer(cfg), pod, admissionv1.Create))
+			for _, name := range []string{"app", "worker"} {
+				if c := findContainer(mutated.Spec.Containers, name); !reflect.DeepEqual(c.VolumeMounts, tt.wantMounts) {
+					t.Errorf("%s mounts = %+v, want %+v", name, c.VolumeMounts, tt.wantMounts)
+				}
+			}
+			// the sidecars don't mount the static volumes
+			if c := findContainer(mutated.Spec.Containers, "sidecar"); len(c.VolumeMounts) != 0 {
+				t.Errorf("sidecar mounts = %+v, want none", c.VolumeMounts)
+			}
+			if !reflect.DeepEqual(mutated.Spec.Volumes, tt.wantVolumes) {
+				t.Errorf("pod volumes = %+v, want %+v", mutated.Spec.Volumes, tt.wantVolumes)
+			}
+		})
+	}
+}
+
+func TestMutateExcludedContainers(t *testing.T) {
+	tests := []struct {
+		name         string
+		value        string
+		wantMounted  []string
+		wantWarnings []string
+	}{
+		{name: "one container", value: "istio-proxy", wantMounted: []string{"app", "worker"}},
+		{name: "several containers", value: " istio-proxy , worker,", wantMounted: []string{"app"}},
+		{
+			name:         "unknown container",
+			value:        "istio-proxy,missing",
+			wantMounted:  []string{"app", "worker"},
+			wantWarnings: []string{`sidecar-injector-webhook.morven.me/exclude-containers annotation names unknown container "missing"`},
+		},
+		{name: "empty", value: "", wantMounted: []string{"app", "istio-proxy", "worker"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "app",
+					Namespace:   "test-ns",
+					Annotations: map[string]string{admissionWebhookAnnotationExcludeKey: tt.value},
+				},
+				Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}, {Name: "istio-proxy"}, {Name: "worker"}}},
+			}
+			resp := mutatePod(t, newTestWebhookServer(patchTestConfig()), pod, admissionv1.Create)
+			mutated := patchedPod(t, pod, resp)
+
+			var mounted []string
+			for _, c := range mutated.Spec.Containers[:3] {
+				if hasVolumeMount(c.VolumeMounts, corev1.VolumeMount{Name: "shared", MountPath: "/shared"}) {
+					mounted = append(mounted, c.Name)
+				}
+			}
+			if !reflect.DeepEqual(mounted, tt.wantMounted) {
+				t.Errorf("containers mounting shared = %v, want %v", mounted, tt.wantMounted)
+			}
+			// the sidecars are injected and mount their volumes regardless
+			if sidecar := findContainer(mutated.Spec.Containers, "sidecar"); sidecar == nil || len(sidecar.VolumeMounts) != 1 {
+				t.Errorf("containers = %+v, want the sidecar injected with its mount", mutated.Spec.Containers)
+			}
+			if !hasVolume(mutated.Spec.Volumes, "shared") {
+				t.Errorf("volumes = %v, want shared injected", volumeNames(mutated.Spec.Volumes))
+			}
+			if !reflect.DeepEqual(resp.Warnings, tt.wantWarnings) {
+				t.Errorf("warnings = %q, want %q", resp.Warnings, tt.wantWarnings)
+			}
+		})
+	}
+}
+
+func TestLogMutatedPod(t *testing.T) {
+	setBoolFlag(t, &debug, true)
+	logged := captureLogger(t, &debugLogger)
+
+	cfg := patchTestConfig()
+	cfg.Containers[0].Env = []corev1.EnvVar{
+		{Name: "API_TOKEN", Value: "sidecar-secret-value"},
+		{Name: "PASSWORD", ValueFrom: &corev1.EnvVarSource{SecretKeyRef: &corev1.SecretKeySelector{
+			LocalObjectReference: corev1.LocalObjectReference{Name: "credentials"},
+			Key:                  "password",
+		}}},
+	}
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "test-ns"},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "app", Env: []corev1.EnvVar{{Name: "DB_PASSWORD", Value: "app-secret-value"}}}},
+			Volumes:    []corev1.Volume{{Name: "data"}},
+		},
+	}
+	mutatePod(t, newTestWebhookServer(cfg), pod, admissionv1.Create)
+
+	var line string
+	for _, l := range strings.Split(logged.String(), "\n") {
+		if strings.Contains(l, "Mutated pod test-ns/app:") {
+			line = l
+		}
+	}
+	if line == "" {
+		t.Fatalf("mutated pod not logged:\n%s", logged.String())
+	}
+	for _, want := range []string{
+		`diff=["+container sidecar" "+container logger" "+volume shared"]`,
+		`"name":"API_TOKEN","value":"REDACTED"`,
+		`"name":"DB_PASSWORD","value":"REDACTED"`,
+		`"secretKeyRef":{"name":"credentials","key":"password"}`,
+	} {
+		if !strings.Contains(line, want) {
+			t.Errorf("mutated pod log does not contain %s:\n%s", want, line)
+		}
+	}
+	// the patch is logged too, with the same values redacted
+	if !strings.Contains(logged.String(), `"name": "API_TOKEN",`) {
+		t.Errorf("patch not logged:\n%s", logged.String())
+	}
+	for _, secret := range []string{"sidecar-secret-value", "app-secret-value"} {
+		if strings.Contains(logged.String(), secret) {
+			t.Errorf("debug log contains the literal env value %q:\n%s", secret, logged.String())
+		}
+	}
+}
+
+func TestRedactPatchEnv(t *testing.T) {
+	tests := []struct {
+		name  string
+		patch string
+		want  string
+	}{
+		{
+			name:  "added container",
+			patch: `[{"op":"add","path":"/spec/containers/-","value":{"name":"sidecar","env":[{"name":"TOKEN","value":"secret"},{"name":"EMPTY","value":""}]}}]`,
+			want:  `[{"op":"add","path":"/spec/containers/-","value":{"env":[{"name":"TOKEN","value":"REDACTED"},{"name":"EMPTY","value":""}],"name":"sidecar"}}]`,
+		},
+		{
+			name:  "added containers",
+			patch: `[{"op":"add","path":"/spec/containers","value":[{"name":"sidecar","env":[{"name":"TOKEN","value":"secret"}]}]}]`,
+			want:  `[{"op":"add","path":"/spec/containers","value":[{"env":[{"name":"TOKEN","value":"REDACTED"}],"name":"sidecar"}]}]`,
+		},
+		{
+			name:  "env list",
+			patch: `[{"op":"add","path":"/spec/initContainers/0/env","value":[{"name":"TOKEN","value":"secret"}]}]`,
+			want:  `[{"op":"add","path":"/spec/initContainers/0/env","value":[{"name":"TOKEN","value":"REDACTED"}]}]`,
+		},
+		{
+			name:  "env var",
+			patch: `[{"op":"add","path":"/spec/initContainers/0/env/-","value":{"name":"TOKEN","value":"secret"}}]`,
+			want:  `[{"op":"add","path":"/spec/initContainers/0/env/-","value":{"name":"TOKEN","value":"REDACTED"}}]`,
+		},
+		{
+			name:  "secret reference",
+			patch: `[{"op":"add","path":"/spec/containers/-","value":{"name":"sidecar","env":[{"name":"TOKEN","valueFrom":{"secretKeyRef":{"name":"credentials","key":"token"}}}]}}]`,
+			want:  `[{"op":"add","path":"/spec/containers/-","value":{"env":[{"name":"TOKEN","valueFrom":{"secretKeyRef":{"key":"token","name":"credentials"}}}],"name":"sidecar"}}]`,
+		},
+		{
+			name:  "other values",
+			patch: `[{"op":"test","path":"/spec/containers/0/name","value":"app"},{"op":"add","path":"/metadata/labels","value":{"env":"prod"}}]`,
+			want:  `[{"op":"test","path":"/spec/containers/0/name","value":"app"},{"op":"add","path":"/metadata/labels","value":{"env":"prod"}}]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := redactPatchEnv([]byte(tt.patch))
+			if err != nil {
+				t.Fatalf("redactPatchEnv returned error: %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("redactPatchEnv = %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetServiceAccountToken(t *testing.T) {
+	cfg := loadTestConfig(t, `
+containers:
+- name: sidecar
+  image: sidecar
+- name: gateway-client
+  image: gateway-client
+  env:
+  - name: SERVICE_ACCOUNT_TOKEN_FILE
+    value: /custom/token
+serviceAccountToken:
+  audience: storage-gateway
+  expirationSeconds: 3600
+  mountPath: /var/run/secrets/gateway
+`)
+	expiration := int64(3600)
+	wantVolume := corev1.Volume{
+		Name: "sidecar-token",
+		VolumeSource: corev1.VolumeSource{
+			Projected: &corev1.ProjectedVolumeSource{
+				Sources: []corev1.VolumeProjection{{
+					ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+						Audience:          "storage-gateway",
+						ExpirationSeconds: &expiration,
+						Path:              "token",
+					},
+				}},
+			},
+		},
+	}
+	if !reflect.DeepEqual(cfg.Volumes, []corev1.Volume{wantVolume}) {
+		t.Errorf("volumes = %+v, want %+v", cfg.Volumes, wantVolume)
+	}
+
+	mount := []corev1.VolumeMount{{Name: "sidecar-token", MountPath: "/var/run/secrets/gateway", ReadOnly: true}}
+	tests := []struct {
+		container string
+		wantEnv   string
+	}{
+		{container: "sidecar", wantEnv: "/var/run/secrets/gateway/token"},
+		// a sidecar defining the variable keeps it
+		{container: "gateway-client", wantEnv: "/custom/token"},
+	}
+	for _, tt := range tests {
+		c := findContainer(cfg.Containers, tt.container)
+		if !reflect.DeepEqual(c.VolumeMounts, mount) {
+			t.Errorf("%s mounts = %+v, want %+v", c.Name, c.VolumeMounts, mount)
+		}
+		if want := []corev1.EnvVar{{Name: "SERVICE_ACCOUNT_TOKEN_FILE", Value: tt.wantEnv}}; !reflect.DeepEqual(c.Env, want) {
+			t.Errorf("%s env = %+v, want %+v", c.Name, c.Env, want)
+		}
+	}
+
+	// the token is for the sidecars only
+	if len(cfg.appVolumeMounts) != 0 {
+		t.Errorf("appVolumeMounts = %+v, want none", cfg.appVolumeMounts)
+	}
+}
+
+func TestServiceAccountTokenValidation(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		wantErr string
+	}{
+		{
+			name:    "duplicate volume name",
+			config:  "volumes:\n- name: sidecar-token\n  emptyDir: {}\nserviceAccountToken:\n  mountPath: /token\n",
+			wantErr: `serviceAccountToken: duplicate volume name "sidecar-token"`,
+		},
+		{
+			name:    "duplicate configured volume name",
+			config:  "volumes:\n- name: token\n  emptyDir: {}\nserviceAccountToken:\n  name: token\n  mountPath: /token\n",
+			wantErr: `serviceAccountToken: duplicate volume name "token"`,
+		},
+		{
+			name:    "short expiration",
+			config:  "serviceAccountToken:\n  mountPath: /token\n  expirationSeconds: 599\n",
+			wantErr: "serviceAccountToken expirationSeconds must be at least 600",
+		},
+		{
+			name:   "minimum expiration",
+			config: "serviceAccountToken:\n  mountPath: /token\n  expirationSeconds: 600\n",
+		},
+		{
+			name:    "relative mount path",
+			config:  "serviceAccountToken:\n  mountPath: token\n",
+			wantErr: `serviceAccountToken mountPath "token" must be an absolute path`,
+		},
+		{
+			name:    "invalid env name",
+			config:  "serviceAccountToken:\n  mountPath: /token\n  envName: 1TOKEN_FILE\n",
+			wantErr: `invalid serviceAccountToken envName "1TOKEN_FILE"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "sidecarconfig.yaml")
+			if err := ioutil.WriteFile(file, []byte("containers:\n- name: sidecar\n  image: sidecar\n"+tt.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := loadConfig(file)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("loadConfig returned error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+				t.Errorf("loadConfig = %v, want error %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestMutateServiceAccountToken(t *testing.T) {
+	cfg := loadTestConfig(t, `
+containers:
+- name: sidecar
+  image: sidecar
+serviceAccountToken:
+  mountPath: /var/run/secrets/gateway
+  envName: GATEWAY_TOKEN_FILE
+`)
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "test-ns"},
+		Spec:       corev1.PodSpec{Containers: []corev1.Container{{Name: "app"}}},
+	}
+	mutated := patchedPod(t, pod, mutatePod(t, newTestWebhookServer(cfg), pod, admissionv1.Create))
+
+	if len(mutated.Spec.Volumes) != 1 || mutated.Spec.Volumes[0].Projected == nil {
+		t.Fatalf("volumes = %+v, want the projected token volume", mutated.Spec.Volumes)
+	}
+	sidecar := findContainer(mutated.Spec.Containers, "sidecar")
+	wantMount := corev1.VolumeMount{Name: "sidecar-token", MountPath: "/var/run/secrets/gateway", ReadOnly: true}
+	if sidecar == nil || !reflect.DeepEqual(sidecar.VolumeMounts, []corev1.VolumeMount{wantMount}) {
+		t.Errorf("sidecar = %+v, want the read-only token mount", sidecar)
+	}
+	if want := []corev1.EnvVar{{Name: "GATEWAY_TOKEN_FILE", Value: "/var/run/secrets/gateway/token"}}; sidecar != nil && !reflect.DeepEqual(sidecar.Env, want) {
+		t.Errorf("sidecar env = %+v, want %+v", sidecar.Env, want)
+	}
+	if app := findContainer(mutated.Spec.Containers, "app"); len(app.VolumeMounts) != 0 {
+		t.Errorf("app mounts = %+v, want the token not mounted", app.VolumeMounts)
+	}
+}
+
+func TestCreatePatchResult(t *testing.T) {
+	annotations := map[string]string{admissionWebhookAnnotationStatusKey: "injected"}
+	tests := []struct {
+		name           string
+		config         func(cfg *Config)
+		pod            func(pod *corev1.Pod)
+		wantSidecars   []string
+		wantVolumes    []string
+		wantSkipped    []string
+		wantOperations int
+	}{
+		{
+			// 2 containers, a test and a mount per pod container, a volume, a pull secret,
+			// a readiness gate, the grace period, the annotations and the labels
+			name:           "default",
+			wantSidecars:   []string{"sidecar", "logger"},
+			wantVolumes:    []string{"shared"},
+			wantOperations: 12,
+		},
+		{
+			name: "mounts skipped",
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{Name: "shared", MountPath: "/app-shared"})
+				pod.Spec.Containers[1].VolumeMounts = []corev1.VolumeMount{{Name: "data", MountPath: "/shared"}}
+			},
+			wantSidecars: []string{"sidecar", "logger"},
+			wantVolumes:  []string{"shared"},
+			wantSkipped:  []string{"app/shared", "worker/shared"},
+			// no test operation either for the containers without a mount to add
+			wantOperations: 8,
+		},
+		{
+			name: "excluded container",
+			config: func(cfg *Config) {
+				cfg.excludedContainers = map[string]bool{"worker": true}
+			},
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.Containers[1].VolumeMounts = []corev1.VolumeMount{{Name: "data", MountPath: "/shared"}}
+			},
+			wantSidecars:   []string{"sidecar", "logger"},
+			wantVolumes:    []string{"shared"},
+			wantOperations: 10,
+		},
+		{
+			name: "no sidecars",
+			config: func(cfg *Config) {
+				*cfg = Config{}
+			},
+			wantSidecars:   []string{},
+			wantVolumes:    []string{},
+			wantOperations: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := patchTestConfig()
+			if tt.config != nil {
+				tt.config(cfg)
+			}
+			pod := patchTestPod()
+			if tt.pod != nil {
+				tt.pod(pod)
+			}
+
+			result, err := createPatch(pod, cfg, annotations)
+			if err != nil {
+				t.Fatalf("createPatch returned error: %v", err)
+			}
+			if !reflect.DeepEqual(result.sidecars, tt.wantSidecars) {
+				t.Errorf("sidecars = %q, want %q", result.sidecars, tt.wantSidecars)
+			}
+			if !reflect.DeepEqual(result.volumes, tt.wantVolumes) {
+				t.Errorf("volumes = %q, want %q", result.volumes, tt.wantVolumes)
+			}
+			if !reflect.DeepEqual(result.skippedMounts, tt.wantSkipped) {
+				t.Errorf("skippedMounts = %q, want %q", result.skippedMounts, tt.wantSkipped)
+			}
+			var ops []patchOperation
+			if err := json.Unmarshal(result.patch, &ops); err != nil {
+				t.Fatal(err)
+			}
+			if result.operations != tt.wantOperations || len(ops) != result.operations {
+				t.Errorf("operations = %d with %d in the patch, want %d", result.operations, len(ops), tt.wantOperations)
+			}
+		})
+	}
+}
+
+func TestMutateSkippedMountWarnings(t *testing.T) {
+	pod := patchTestPod()
+	pod.Spec.Containers[0].VolumeMounts = append(pod.Spec.Containers[0].VolumeMounts, corev1.VolumeMount{Name: "shared", MountPath: "/app-shared"})
+	resp := mutatePod(t, newTestWebhookServer(patchTestConfig()), pod, admissionv1.Create)
+	want := []string{"volume mount app/shared not injected, the container already mounts that volume name or path"}
+	if !reflect.DeepEqual(resp.Warnings, want) {
+		t.Errorf("warnings = %q, want %q", resp.Warnings, want)
+	}
+}
+
+func TestMutateWarnings(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       string
+		pod          func(pod *corev1.Pod)
+		wantPatch    bool
+		wantWarnings []string
+	}{
+		{
+			name:      "none",
+			policy:    nameConflictPolicyRename,
+			wantPatch: true,
+		},
+		{
+			name:   "renamed",
+			policy: nameConflictPolicyRename,
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "logger"})
+				pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{Name: "shared"})
+			},
+			wantPatch: true,
+			wantWarnings: []string{
+				"renamed injected container logger to logger-2, the pod already uses that name",
+				"renamed injected volume shared to shared-2, the pod already uses that name",
+			},
+		},
+		{
+			name:   "skipped on a name clash",
+			policy: nameConflictPolicySkip,
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{Name: "shared"})
+			},
+			wantWarnings: []string{"sidecars not injected: pod already has volume shared"},
+		},
+		{
+			name:   "unrecognized annotations",
+			policy: nameConflictPolicyRename,
+			pod: func(pod *corev1.Pod) {
+				pod.Annotations = map[string]string{
+					admissionWebhookAnnotationInjectKey:      "maybe",
+					admissionWebhookAnnotationReadOnlyAllKey: "sometimes",
+				}
+			},
+			wantPatch: true,
+			wantWarnings: []string{
+				`unrecognized sidecar-injector-webhook.morven.me/inject annotation value "maybe", expect yes or no, sidecars injected: true`,
+				`ignoring sidecar-injector-webhook.morven.me/read-only-all annotation, unrecognized value "sometimes", expect true or false`,
+			},
+		},
+		{
+			name:   "skipped mount",
+			policy: nameConflictPolicyRename,
+			pod: func(pod *corev1.Pod) {
+				pod.Spec.Containers[1].VolumeMounts = []corev1.VolumeMount{{Name: "data", MountPath: "/shared"}}
+			},
+			wantPatch:    true,
+			wantWarnings: []string{"volume mount worker/shared not injected, the container already mounts that volume name or path"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setNameConflictPolicy(t, tt.policy)
+			setBoolFlag(t, &injectByDefault, true)
+			pod := patchTestPod()
+			if tt.pod != nil {
+				tt.pod(pod)
+			}
+			resp := mutatePod(t, newTestWebhookServer(patchTestConfig()), pod, admissionv1.Create)
+			if !reflect.DeepEqual(resp.Warnings, tt.wantWarnings) {
+				t.Errorf("warnings = %q, want %q", resp.Warnings, tt.wantWarnings)
+			}
+			if gotPatch := len(resp.Patch) > 0; gotPatch != tt.wantPatch {
+				t.Errorf("patched = %v, want %v", gotPatch, tt.wantPatch)
+			}
+		})
+	}
+}
+
+func TestServeWarnings(t *testing.T) {
+	setNameConflictPolicy(t, nameConflictPolicyRename)
+	pod := patchTestPod()
+	pod.Spec.Containers = append(pod.Spec.Containers, corev1.Container{Name: "logger"})
+
+	_, review := serveReview(t, newTestWebhookServer(patchTestConfig()), podReview(t, pod), "application/json")
+	if review == nil {
+		t.Fatal("serve did not answer with an AdmissionReview")
+	}
+	want := []string{"renamed injected container logger to logger-2, the pod already uses that name"}
+	if !reflect.DeepEqual(review.Response.Warnings, want) {
+		t.Errorf("warnings = %q, want %q", review.Response.Warnings, want)
+	}
+}
+
+func TestServeContentType(t *testing.T) {
+	body := podReview(t, patchTestPod())
+	tests := []struct {
+		contentType string
+		wantCode    int
+	}{
+		{contentType: "application/json", wantCode: http.StatusOK},
+		{contentType: "application/json; charset=utf-8", wantCode: http.StatusOK},
+		{contentType: "Application/JSON;charset=UTF-8", wantCode: http.StatusOK},
+		{contentType: "text/plain", wantCode: http.StatusUnsupportedMediaType},
+		{contentType: "application/yaml", wantCode: http.StatusUnsupportedMediaType},
+		{contentType: "application/json-patch+json", wantCode: http.StatusUnsupportedMediaType},
+		{contentType: "application/json; charset", wantCode: http.StatusUnsupportedMediaType},
+		{contentType: "", wantCode: http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			w, review := serveReview(t, newTestWebhookServer(patchTestConfig()), body, tt.contentType)
+			if w.Code != tt.wantCode {
+				t.Fatalf("serve returned HTTP %d %q, want %d", w.Code, w.Body.String(), tt.wantCode)
+			}
+			if tt.wantCode == http.StatusOK && (!review.Response.Allowed || len(review.Response.Patch) == 0) {
+				t.Errorf("response = %+v, want the pod injected", review.Response)
+			}
+		})
+	}
+}
+
+func TestServeNonPodKind(t *testing.T) {
+	tests := []struct {
+		name        string
+		kind        string
+		object      string
+		wantWarning string
+	}{
+		{
+			name:        "deployment",
+			kind:        `{"group":"apps","version":"v1","kind":"Deployment"}`,
+			object:      `{"apiVersion":"apps/v1","kind":"Deployment","metadata":{"name":"app","namespace":"test-ns"}}`,
+			wantWarning: "sidecar injector only mutates pods, Deployment/app was admitted unchanged",
+		},
+		{
+			name:        "config map",
+			kind:        `{"group":"","version":"v1","kind":"ConfigMap"}`,
+			object:      `{"apiVersion":"v1","kind":"ConfigMap","metadata":{"name":"app","namespace":"test-ns"}}`,
+			wantWarning: "sidecar injector only mutates pods, ConfigMap/app was admitted unchanged",
+		},
+		{
+			// a Pod kind of another group is not a core pod
+			name:        "pod of another group",
+			kind:        `{"group":"example.com","version":"v1","kind":"Pod"}`,
+			object:      `{"apiVersion":"example.com/v1","kind":"Pod","metadata":{"name":"app","namespace":"test-ns"},"spec":{"containers":[{"name":"app"}]}}`,
+			wantWarning: "sidecar injector only mutates pods, Pod/app was admitted unchanged",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","request":{"uid":"uid-kind",` +
+				`"kind":` + tt.kind + `,"operation":"CREATE","namespace":"test-ns","name":"app","object":` + tt.object + `}}`
+			w, review := serveReview(t, newTestWebhookServer(patchTestConfig()), body, "application/json")
+			if review == nil {
+				t.Fatalf("serve returned HTTP %d %q, want an AdmissionReview", w.Code, w.Body.String())
+			}
+			resp := review.Response
+			if !resp.Allowed || resp.UID != "uid-kind" {
+				t.Errorf("response = %+v, want allowed with the request uid", resp)
+			}
+			if len(resp.Patch) != 0 || resp.PatchType != nil {
+				t.Errorf("patch = %s, want none", resp.Patch)
+			}
+			if want := []string{tt.wantWarning}; !reflect.DeepEqual(resp.Warnings, want) {
+				t.Errorf("warnings = %q, want %q", resp.Warnings, want)
+			}
+		})
+	}
+}
+
+func TestMutateInjectedByAnnotation(t *testing.T) {
+	tests := []struct {
+		name     string
+		instance string
+		existing map[string]string
+	}{
+		{name: "configured", instance: "sidecar-injector-7d9f8b6c4-x2kqp"},
+		{name: "replaces a copied value", instance: "sidecar-injector-7d9f8b6c4-x2kqp", existing: map[string]string{admissionWebhookAnnotationInjectedByKey: "sidecar-injector-old"}},
+		{name: "unset"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			old := instanceName
+			instanceName = tt.instance
+			t.Cleanup(func() { instanceName = old })
+
+			pod := patchTestPod()
+			pod.Annotations = tt.existing
+			mutated := patchedPod(t, pod, mutatePod(t, newTestWebhookServer(patchTestConfig()), pod, admissionv1.Create))
+
+			got, ok := mutated.Annotations[admissionWebhookAnnotationInjectedByKey]
+			switch {
+			case tt.instance != "" && got != tt.instance:
+				t.Errorf("%s annotation = %q, want %q", admissionWebhookAnnotationInjectedByKey, got, tt.instance)
+			case tt.instance == "" && ok:
+				t.Errorf("%s annotation = %q, want unset without -instance-name", admissionWebhookAnnotationInjectedByKey, got)
+			}
+			if mutated.Annotations[admissionWebhookAnnotationStatusKey] != "injected" {
+				t.Errorf("annotations = %v, want the pod injected", mutated.Annotations)
+			}
+		})
+	}
+}
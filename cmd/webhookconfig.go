@@ -3,12 +3,16 @@ package main
 import (
 	"bytes"
 	"context"
+	"fmt"
+	"net/url"
 	"os"
 	"reflect"
+	"strings"
 
 	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 )
@@ -16,26 +20,54 @@ import (
 var (
 	webhookConfigName = "sidecar-injector-webhook"
 	webhookInjectPath = "/inject"
+	// pods in namespaces with this label are sent to the webhook
+	namespaceSelectorLabels = map[string]string{"sidecar-injection": "enabled"}
 )
 
-func createOrUpdateMutatingWebhookConfiguration(caPEM *bytes.Buffer, webhookService, webhookNamespace string) error {
+// newKubeClient creates the kube client from $KUBECONFIG or the in-cluster config
+func newKubeClient() (kubernetes.Interface, error) {
 	infoLogger.Println("Initializing the kube client...")
 
 	kubeconfig := os.Getenv("KUBECONFIG")
 	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
 	if err != nil {
-		return err
-	}
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
-		return err
+		return nil, err
 	}
-	mutatingWebhookConfigV1Client := clientset.AdmissionregistrationV1()
+	return kubernetes.NewForConfig(config)
+}
 
-	infoLogger.Printf("Creating or updating the mutatingwebhookconfiguration: %s", webhookConfigName)
-	fail := admissionregistrationv1.Fail
+// newMutatingWebhookConfiguration builds the mutatingwebhookconfiguration pointing at the webhook service
+func newMutatingWebhookConfiguration(caBundle []byte, webhookService, webhookNamespace string,
+	failurePolicy admissionregistrationv1.FailurePolicyType, reinvocationPolicy admissionregistrationv1.ReinvocationPolicyType) *admissionregistrationv1.MutatingWebhookConfiguration {
+	operations := []admissionregistrationv1.OperationType{admissionregistrationv1.Create}
+	if injectOnUpdate {
+		operations = append(operations, admissionregistrationv1.Update)
+	}
+	rules := []admissionregistrationv1.RuleWithOperations{{
+		Operations: operations,
+		Rule: admissionregistrationv1.Rule{
+			APIGroups:   []string{""},
+			APIVersions: []string{"v1"},
+			Resources:   []string{"pods"},
+		},
+	}}
+	if ephemeralContainers {
+		rules = append(rules, admissionregistrationv1.RuleWithOperations{
+			Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Update},
+			Rule: admissionregistrationv1.Rule{
+				APIGroups:   []string{""},
+				APIVersions: []string{"v1"},
+				Resources:   []string{"pods/" + ephemeralContainersSubResource},
+			},
+		})
+	}
 	sideEffect := admissionregistrationv1.SideEffectClassNone
-	mutatingWebhookConfig := &admissionregistrationv1.MutatingWebhookConfiguration{
+	path := webhookInjectPath
+	return &admissionregistrationv1.MutatingWebhookConfiguration{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: admissionregistrationv1.SchemeGroupVersion.String(),
+			Kind:       "MutatingWebhookConfiguration",
+		},
 		ObjectMeta: metav1.ObjectMeta{
 			Name: webhookConfigName,
 		},
@@ -44,34 +76,30 @@ func createOrUpdateMutatingWebhookConfiguration(caPEM *bytes.Buffer, webhookServ
 			AdmissionReviewVersions: []string{"v1", "v1beta1"},
 			SideEffects:             &sideEffect,
 			ClientConfig: admissionregistrationv1.WebhookClientConfig{
-				CABundle: caPEM.Bytes(), // self-generated CA for the webhook
+				CABundle: caBundle,
 				Service: &admissionregistrationv1.ServiceReference{
 					Name:      webhookService,
 					Namespace: webhookNamespace,
-					Path:      &webhookInjectPath,
-				},
-			},
-			Rules: []admissionregistrationv1.RuleWithOperations{
-				{
-					Operations: []admissionregistrationv1.OperationType{
-						admissionregistrationv1.Create,
-						admissionregistrationv1.Update,
-					},
-					Rule: admissionregistrationv1.Rule{
-						APIGroups:   []string{""},
-						APIVersions: []string{"v1"},
-						Resources:   []string{"pods"},
-					},
+					Path:      &path,
 				},
 			},
+			Rules: rules,
 			NamespaceSelector: &metav1.LabelSelector{
-				MatchLabels: map[string]string{
-					"sidecar-injection": "enabled",
-				},
+				MatchLabels: namespaceSelectorLabels,
 			},
-			FailurePolicy: &fail,
+			FailurePolicy:      &failurePolicy,
+			ReinvocationPolicy: &reinvocationPolicy,
 		}},
 	}
+}
+
+func createOrUpdateMutatingWebhookConfiguration(clientset kubernetes.Interface, caPEM *bytes.Buffer, webhookService, webhookNamespace string) error {
+	mutatingWebhookConfigV1Client := clientset.AdmissionregistrationV1()
+
+	infoLogger.Printf("Creating or updating the mutatingwebhookconfiguration: %s", webhookConfigName)
+	// self-generated CA for the webhook
+	mutatingWebhookConfig := newMutatingWebhookConfiguration(caPEM.Bytes(), webhookService, webhookNamespace,
+		admissionregistrationv1.Fail, admissionregistrationv1.NeverReinvocationPolicy)
 
 	foundWebhookConfig, err := mutatingWebhookConfigV1Client.MutatingWebhookConfigurations().Get(context.TODO(), webhookConfigName, metav1.GetOptions{})
 	if err != nil && apierrors.IsNotFound(err) {
@@ -90,6 +118,7 @@ func createOrUpdateMutatingWebhookConfiguration(caPEM *bytes.Buffer, webhookServ
 				reflect.DeepEqual(foundWebhookConfig.Webhooks[0].AdmissionReviewVersions, mutatingWebhookConfig.Webhooks[0].AdmissionReviewVersions) &&
 				reflect.DeepEqual(foundWebhookConfig.Webhooks[0].SideEffects, mutatingWebhookConfig.Webhooks[0].SideEffects) &&
 				reflect.DeepEqual(foundWebhookConfig.Webhooks[0].FailurePolicy, mutatingWebhookConfig.Webhooks[0].FailurePolicy) &&
+				reflect.DeepEqual(foundWebhookConfig.Webhooks[0].ReinvocationPolicy, mutatingWebhookConfig.Webhooks[0].ReinvocationPolicy) &&
 				reflect.DeepEqual(foundWebhookConfig.Webhooks[0].Rules, mutatingWebhookConfig.Webhooks[0].Rules) &&
 				reflect.DeepEqual(foundWebhookConfig.Webhooks[0].NamespaceSelector, mutatingWebhookConfig.Webhooks[0].NamespaceSelector) &&
 				reflect.DeepEqual(foundWebhookConfig.Webhooks[0].ClientConfig.CABundle, mutatingWebhookConfig.Webhooks[0].ClientConfig.CABundle) &&
@@ -106,3 +135,36 @@ func createOrUpdateMutatingWebhookConfiguration(caPEM *bytes.Buffer, webhookServ
 
 	return nil
 }
+
+// parseNamespaceSelector parses a comma-separated list of key=value namespace labels
+func parseNamespaceSelector(value string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid namespace selector %q, expect key=value[,key=value]", value)
+		}
+		if errs := validation.IsQualifiedName(kv[0]); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid label key %q: %s", kv[0], strings.Join(errs, "; "))
+		}
+		if errs := validation.IsValidLabelValue(kv[1]); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid value %q of label %q: %s", kv[1], kv[0], strings.Join(errs, "; "))
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return labels, nil
+}
+
+// parseWebhookPath checks the webhook path is an absolute URL path that does not shadow the
+// health, metrics or config endpoints
+func parseWebhookPath(value string) (string, error) {
+	u, err := url.Parse(value)
+	if err != nil || !strings.HasPrefix(value, "/") || u.Path != value {
+		return "", fmt.Errorf("invalid webhook path %q, expect an absolute path such as /inject", value)
+	}
+	switch value {
+	case "/", "/readyz", "/metrics", "/config":
+		return "", fmt.Errorf("webhook path %q is reserved", value)
+	}
+	return value, nil
+}
@@ -0,0 +1,228 @@
+//go:build e2e
+// +build e2e
+
+// Package e2e runs the sidecar injector against a real cluster. It expects the injector to be
+// deployed with the manifests in deploy/ (make deploy) in the cluster selected by $KUBECONFIG,
+// and is run with make e2e.
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	injectAnnotation = "sidecar-injector-webhook.morven.me/inject"
+	statusAnnotation = "sidecar-injector-webhook.morven.me/status"
+
+	// sidecar and volume from deploy/configmap.yaml
+	sidecarName       = "sidecar-nginx"
+	sidecarVolumeName = "nginx-conf"
+)
+
+var namespaceSelectorLabels = map[string]string{"sidecar-injection": "enabled"}
+
+func newKubeClient(t *testing.T) kubernetes.Interface {
+	t.Helper()
+
+	kubeconfig := os.Getenv("KUBECONFIG")
+	if kubeconfig == "" {
+		t.Skip("KUBECONFIG is not set")
+	}
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		t.Fatalf("Failed to load %s: %v", kubeconfig, err)
+	}
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		t.Fatalf("Failed to create the kube client: %v", err)
+	}
+	return client
+}
+
+// createNamespace creates a namespace with a generated name that is deleted when the test ends
+func createNamespace(t *testing.T, client kubernetes.Interface, labels map[string]string) string {
+	t.Helper()
+
+	ctx := context.Background()
+	ns, err := client.CoreV1().Namespaces().Create(ctx, &corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: "sidecar-injector-e2e-", Labels: labels},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create namespace: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := client.CoreV1().Namespaces().Delete(context.Background(), ns.Name, metav1.DeleteOptions{}); err != nil {
+			t.Errorf("Failed to delete namespace %s: %v", ns.Name, err)
+		}
+	})
+	return ns.Name
+}
+
+// createPod creates a pod and returns it as stored by the API server, so after admission
+func createPod(t *testing.T, client kubernetes.Interface, namespace string, annotations map[string]string) *corev1.Pod {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Annotations: annotations},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name:    "app",
+				Image:   "busybox",
+				Command: []string{"sleep", "3600"},
+				VolumeMounts: []corev1.VolumeMount{{
+					Name:      "app-data",
+					MountPath: "/data",
+				}},
+			}},
+			Volumes: []corev1.Volume{{
+				Name:         "app-data",
+				VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+			}},
+		},
+	}
+	if _, err := client.CoreV1().Pods(namespace).Create(ctx, pod, metav1.CreateOptions{}); err != nil {
+		t.Fatalf("Failed to create pod: %v", err)
+	}
+	stored, err := client.CoreV1().Pods(namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("Failed to get pod: %v", err)
+	}
+	return stored
+}
+
+func findContainer(pod *corev1.Pod, name string) *corev1.Container {
+	for i := range pod.Spec.Containers {
+		if pod.Spec.Containers[i].Name == name {
+			return &pod.Spec.Containers[i]
+		}
+	}
+	return nil
+}
+
+func hasVolume(pod *corev1.Pod, name string) bool {
+	for _, volume := range pod.Spec.Volumes {
+		if volume.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func hasVolumeMount(container *corev1.Container, name string) bool {
+	for _, mount := range container.VolumeMounts {
+		if mount.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func assertInjected(t *testing.T, pod *corev1.Pod) {
+	t.Helper()
+
+	if status := pod.Annotations[statusAnnotation]; status != "injected" {
+		t.Errorf("%s annotation = %q, want injected", statusAnnotation, status)
+	}
+	sidecar := findContainer(pod, sidecarName)
+	if sidecar == nil {
+		t.Fatalf("containers = %v, want %s injected", containerNames(pod), sidecarName)
+	}
+	if !hasVolume(pod, sidecarVolumeName) {
+		t.Errorf("volume %s not injected", sidecarVolumeName)
+	}
+	if !hasVolumeMount(sidecar, sidecarVolumeName) {
+		t.Errorf("%s is missing the %s mount", sidecarName, sidecarVolumeName)
+	}
+	if app := findContainer(pod, "app"); app == nil || !hasVolumeMount(app, "app-data") {
+		t.Errorf("app container or its app-data mount was not kept")
+	}
+	if !hasVolume(pod, "app-data") {
+		t.Errorf("app-data volume was not kept")
+	}
+}
+
+func assertNotInjected(t *testing.T, pod *corev1.Pod) {
+	t.Helper()
+
+	if status, ok := pod.Annotations[statusAnnotation]; ok {
+		t.Errorf("%s annotation = %q, want unset", statusAnnotation, status)
+	}
+	if findContainer(pod, sidecarName) != nil {
+		t.Errorf("containers = %v, want %s not injected", containerNames(pod), sidecarName)
+	}
+	if hasVolume(pod, sidecarVolumeName) {
+		t.Errorf("volume %s injected", sidecarVolumeName)
+	}
+}
+
+func containerNames(pod *corev1.Pod) []string {
+	names := make([]string, 0, len(pod.Spec.Containers))
+	for _, container := range pod.Spec.Containers {
+		names = append(names, container.Name)
+	}
+	return names
+}
+
+func TestInjection(t *testing.T) {
+	client := newKubeClient(t)
+
+	tests := []struct {
+		name        string
+		labels      map[string]string
+		annotations map[string]string
+		injected    bool
+	}{
+		{
+			name:     "labeled namespace",
+			labels:   namespaceSelectorLabels,
+			injected: true,
+		},
+		{
+			name:        "inject annotation yes",
+			labels:      namespaceSelectorLabels,
+			annotations: map[string]string{injectAnnotation: "yes"},
+			injected:    true,
+		},
+		{
+			name:        "inject annotation false",
+			labels:      namespaceSelectorLabels,
+			annotations: map[string]string{injectAnnotation: "false"},
+		},
+		{
+			name: "namespace label missing",
+		},
+		{
+			name:   "namespace label disabled",
+			labels: map[string]string{"sidecar-injection": "disabled"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			namespace := createNamespace(t, client, tt.labels)
+			pod := createPod(t, client, namespace, tt.annotations)
+			if tt.injected {
+				assertInjected(t, pod)
+			} else {
+				assertNotInjected(t, pod)
+			}
+			if t.Failed() {
+				t.Logf("pod %s/%s: %s", namespace, pod.Name, describe(pod))
+			}
+		})
+	}
+}
+
+func describe(pod *corev1.Pod) string {
+	return fmt.Sprintf("annotations=%v containers=%v volumes=%d", pod.Annotations, containerNames(pod), len(pod.Spec.Volumes))
+}